@@ -8,8 +8,12 @@ package alsa
 import (
 	"errors"
 	"fmt"
+	"log"
 	"reflect"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
@@ -46,11 +50,50 @@ const (
 	FormatFloat64BE = C.SND_PCM_FORMAT_FLOAT64_BE
 )
 
+// interleavedAccess names the access type used by all devices.
+var interleavedAccess = C.GoString(C.snd_pcm_access_name(C.SND_PCM_ACCESS_RW_INTERLEAVED))
+
+// allFormats lists the supported sample formats.
+var allFormats = []Format{
+	FormatS8, FormatU8,
+	FormatS16LE, FormatS16BE, FormatU16LE, FormatU16BE,
+	FormatS24LE, FormatS24BE, FormatU24LE, FormatU24BE,
+	FormatS32LE, FormatS32BE, FormatU32LE, FormatU32BE,
+	FormatFloatLE, FormatFloatBE,
+	FormatFloat64LE, FormatFloat64BE,
+}
+
+// State is the type used for reporting the state of a device.
+type State C.snd_pcm_state_t
+
+// The states a device may be in.
+const (
+	StateOpen         = C.SND_PCM_STATE_OPEN
+	StateSetup        = C.SND_PCM_STATE_SETUP
+	StatePrepared     = C.SND_PCM_STATE_PREPARED
+	StateRunning      = C.SND_PCM_STATE_RUNNING
+	StateXrun         = C.SND_PCM_STATE_XRUN
+	StateDraining     = C.SND_PCM_STATE_DRAINING
+	StatePaused       = C.SND_PCM_STATE_PAUSED
+	StateSuspended    = C.SND_PCM_STATE_SUSPENDED
+	StateDisconnected = C.SND_PCM_STATE_DISCONNECTED
+)
+
 var (
 	// ErrOverrun signals an overrun error
 	ErrOverrun = errors.New("overrun")
 	// ErrUnderrun signals an underrun error
 	ErrUnderrun = errors.New("underrun")
+	// ErrOpenTimeout signals that opening a device took too long
+	ErrOpenTimeout = errors.New("timed out opening device")
+	// ErrClosed signals an operation on a closed device
+	ErrClosed = errors.New("device is closed")
+	// ErrNoPCMVolume signals that a device has no volume control of its own
+	ErrNoPCMVolume = errors.New("no volume control for PCM")
+	// ErrPauseUnsupported signals that the hardware cannot pause
+	ErrPauseUnsupported = errors.New("device does not support pausing")
+	// ErrStop may be returned by a Capture handler to stop capturing
+	ErrStop = errors.New("stop")
 )
 
 // BufferParams specifies the buffer parameters of a device.
@@ -58,6 +101,95 @@ type BufferParams struct {
 	BufferFrames int
 	PeriodFrames int
 	Periods      int
+	// StartWhenFull delays starting playback until the buffer is full.
+	StartWhenFull bool
+	// PowerOfTwoPeriod selects the largest power of two period size the
+	// hardware supports which is no larger than the requested size.
+	PowerOfTwoPeriod bool
+	// ExportBuffer allocates the ring buffer so that it can be exported
+	// and shared with other subsystems.
+	ExportBuffer bool
+}
+
+// ParamAdjustment records a parameter the hardware did not grant exactly.
+type ParamAdjustment struct {
+	Param     string
+	Requested int
+	Granted   int
+}
+
+// DeviceConfig describes the configuration of a device. Zero values in a
+// requested configuration mean the default was asked for.
+type DeviceConfig struct {
+	Access       string
+	Format       Format
+	Rate         int
+	Channels     int
+	BufferFrames int
+	PeriodFrames int
+	Periods      int
+}
+
+// ConfigReport pairs the configuration requested for a device with the one
+// granted by the hardware.
+type ConfigReport struct {
+	Requested DeviceConfig
+	Granted   DeviceConfig
+}
+
+// ClosePolicy is the type used for specifying how Close treats audio still
+// queued in the device.
+type ClosePolicy int
+
+// The policies available for closing a device.
+const (
+	// ClosePolicyAuto waits for queued audio to play, unless the device has
+	// failed or been disconnected and waiting could hang, in which case the
+	// audio is discarded.
+	ClosePolicyAuto ClosePolicy = iota
+	// ClosePolicyDrain always waits for queued audio to play.
+	ClosePolicyDrain
+	// ClosePolicyDrop always discards queued audio.
+	ClosePolicyDrop
+)
+
+// DeviceOptions specifies optional behaviour of a device.
+type DeviceOptions struct {
+	// ThreadSafe serialises Read, Write and Close with an internal mutex so
+	// that the device may be shared between goroutines.
+	ThreadSafe bool
+	// ChunkFrames limits the number of frames passed to ALSA in one call,
+	// larger writes are split into several calls. It defaults to the
+	// buffer size. A ThreadSafe device closed during a write is closed
+	// once the current chunk has been written.
+	ChunkFrames int
+	// FallbackToNear retries any format, channels, rate, buffer or period
+	// setting the hardware cannot grant exactly with the nearest it can,
+	// rather than failing. The changes are reported by Adjustments. Write
+	// does not convert samples, so a changed format must be checked for.
+	FallbackToNear bool
+	// FallbackChannels retries a channel count the hardware cannot grant
+	// with the nearest it can, for example mono for a stereo request to a
+	// mono microphone. The change is reported by Adjustments.
+	FallbackChannels bool
+	// OpenTimeout limits how long opening the device may take, after
+	// which ErrOpenTimeout is returned. The underlying open may still be in
+	// progress after the timeout, the device is closed if it completes.
+	OpenTimeout time.Duration
+	// LatencyWarning logs a warning when the device is created if its
+	// estimated latency exceeds this duration.
+	LatencyWarning time.Duration
+	// ClosePolicy selects how Close treats audio still queued in the
+	// device.
+	ClosePolicy ClosePolicy
+	// ChannelsAuto ignores the requested channel count and opens the
+	// device with the most channels it supports.
+	ChannelsAuto bool
+	// ClientName labels the stream when ALSA is routed through PipeWire or
+	// PulseAudio, so that it can be identified in their mixers. The plugins
+	// only read the label from the environment, so it is set for the
+	// duration of the open, during which other labelled opens wait.
+	ClientName string
 }
 
 type device struct {
@@ -68,29 +200,160 @@ type device struct {
 	BufferParams BufferParams
 	frames       int
 	readerThread *C.reader_thread_state
+	ring         *captureRing
+	chunkFrames  int
+	adjustments  []ParamAdjustment
+	requested    DeviceConfig
+	closePolicy  ClosePolicy
+	// underruns and overruns are accessed atomically
+	underruns uint32
+	overruns  uint32
+	// closing is set atomically when Close begins, so that a chunked
+	// write in progress stops at the next chunk and Capture at the next
+	// read
+	closing int32
+	// mu is only set for thread safe devices
+	mu *sync.Mutex
+	// ops is only set by tests
+	ops *pcmOps
+}
+
+// Version returns the version of the ALSA library in use.
+func Version() string {
+	return C.GoString(C.snd_asoundlib_version())
 }
 
 func createError(errorMsg string, errorCode C.int) (err error) {
 	strError := C.GoString(C.snd_strerror(errorCode))
+	if errorCode == -C.EBADFD {
+		// Usually the stream has been stopped and needs preparing again
+		err = fmt.Errorf("%s: %s: device is in an invalid state for this operation, call Prepare() first", errorMsg, strError)
+		return
+	}
 	err = fmt.Errorf("%s: %s", errorMsg, strError)
 	return
 }
 
-func (d *device) createDevice(deviceName string, channels int, format Format, rate int, playback bool, bufferParams BufferParams) (err error) {
-	deviceCString := C.CString(deviceName)
-	defer C.free(unsafe.Pointer(deviceCString))
-	var ret C.int
+func (d *device) open(deviceName string, playback bool, options DeviceOptions) (err error) {
+	var stream C.snd_pcm_stream_t = C.SND_PCM_STREAM_CAPTURE
 	if playback {
-		ret = C.snd_pcm_open(&d.h, deviceCString, C.SND_PCM_STREAM_PLAYBACK, 0)
+		stream = C.SND_PCM_STREAM_PLAYBACK
+	}
+	var ret int
+	if options.OpenTimeout > 0 {
+		type result struct {
+			h   pcmHandle
+			ret int
+		}
+		done := make(chan result, 1)
+		go func() {
+			h, ret := d.openLabelled(deviceName, stream, options.ClientName)
+			done <- result{h, ret}
+		}()
+		select {
+		case r := <-done:
+			d.h, ret = r.h, r.ret
+		case <-time.After(options.OpenTimeout):
+			// Close the device if the open ever completes
+			go func() {
+				if r := <-done; r.ret >= 0 {
+					d.pcm().close(r.h)
+				}
+			}()
+			return ErrOpenTimeout
+		}
 	} else {
-		ret = C.snd_pcm_open(&d.h, deviceCString, C.SND_PCM_STREAM_CAPTURE, 0)
+		d.h, ret = d.openLabelled(deviceName, stream, options.ClientName)
 	}
 	if ret < 0 {
 		return fmt.Errorf("could not open ALSA device %s", deviceName)
 	}
 	runtime.SetFinalizer(d, (*device).Close)
+	return
+}
+
+// pcmHandle and pcmStream name the ALSA types used by pcmOps so that tests,
+// which cannot use cgo, can replace them.
+type (
+	pcmHandle = *C.snd_pcm_t
+	pcmStream = C.snd_pcm_stream_t
+)
+
+// pcmOps holds the ALSA calls a device makes which tests replace to
+// simulate slow opens, xruns, short writes and link groups the null PCM
+// cannot produce. A device with no ops set uses defaultPCMOps; tests copy
+// the defaults, override the calls they need and set the copy on the
+// device before use.
+type pcmOps struct {
+	open   func(deviceName string, stream pcmStream, mode int) (pcmHandle, int)
+	close  func(h pcmHandle) int
+	wait   func(h pcmHandle, timeoutMs int) int
+	writei func(h pcmHandle, buf unsafe.Pointer, frames int) int
+	link   func(h1, h2 pcmHandle) int
+	unlink func(h pcmHandle) int
+}
+
+var defaultPCMOps = pcmOps{
+	open:  openPCM,
+	close: func(h pcmHandle) int { return int(C.snd_pcm_close(h)) },
+	wait:  func(h pcmHandle, timeoutMs int) int { return int(C.snd_pcm_wait(h, C.int(timeoutMs))) },
+	writei: func(h pcmHandle, buf unsafe.Pointer, frames int) int {
+		return int(C.snd_pcm_writei(h, buf, C.snd_pcm_uframes_t(frames)))
+	},
+	link:   func(h1, h2 pcmHandle) int { return int(C.snd_pcm_link(h1, h2)) },
+	unlink: func(h pcmHandle) int { return int(C.snd_pcm_unlink(h)) },
+}
+
+func (d *device) pcm() *pcmOps {
+	if d.ops != nil {
+		return d.ops
+	}
+	return &defaultPCMOps
+}
+
+// openPCM wraps snd_pcm_open.
+func openPCM(deviceName string, stream pcmStream, mode int) (h pcmHandle, ret int) {
+	deviceCString := C.CString(deviceName)
+	defer C.free(unsafe.Pointer(deviceCString))
+	ret = int(C.snd_pcm_open(&h, deviceCString, stream, C.int(mode)))
+	return
+}
+
+// openLabelled opens a PCM, labelling the stream with clientName if it is
+// set. Labelled opens are serialised with clientNameMu, a timed out one
+// keeping the lock until snd_pcm_open actually returns, so only another
+// labelled open can be held up by one which hangs. An unlabelled open
+// made while a labelled one is in progress may pick up its label.
+func (d *device) openLabelled(deviceName string, stream pcmStream, clientName string) (pcmHandle, int) {
+	if clientName == "" {
+		return d.pcm().open(deviceName, stream, 0)
+	}
+	clientNameMu.Lock()
+	defer clientNameMu.Unlock()
+	defer setClientName(clientName)()
+	return d.pcm().open(deviceName, stream, 0)
+}
+
+func (d *device) createDevice(deviceName string, channels int, format Format, rate int, playback bool, bufferParams BufferParams, options DeviceOptions) (err error) {
+	if options.ThreadSafe {
+		d.mu = new(sync.Mutex)
+	}
+	d.closePolicy = options.ClosePolicy
+	d.requested = DeviceConfig{
+		Access:       interleavedAccess,
+		Format:       format,
+		Rate:         rate,
+		Channels:     channels,
+		BufferFrames: bufferParams.BufferFrames,
+		PeriodFrames: bufferParams.PeriodFrames,
+		Periods:      bufferParams.Periods,
+	}
+	err = d.open(deviceName, playback, options)
+	if err != nil {
+		return err
+	}
 	var hwParams *C.snd_pcm_hw_params_t
-	ret = C.snd_pcm_hw_params_malloc(&hwParams)
+	ret := C.snd_pcm_hw_params_malloc(&hwParams)
 	if ret < 0 {
 		return createError("could not alloc hw params", ret)
 	}
@@ -103,15 +366,49 @@ func (d *device) createDevice(deviceName string, channels int, format Format, ra
 	if ret < 0 {
 		return createError("could not set access params", ret)
 	}
+	if bufferParams.ExportBuffer {
+		ret = C.snd_pcm_hw_params_set_export_buffer(d.h, hwParams, 1)
+		if ret < 0 {
+			return createError("could not set export buffer", ret)
+		}
+	}
+	d.adjustments = nil
 	ret = C.snd_pcm_hw_params_set_format(d.h, hwParams, C.snd_pcm_format_t(format))
+	if ret < 0 && options.FallbackToNear {
+		if nearest, ok := nearestFormat(d.h, hwParams, format); ok {
+			ret = C.snd_pcm_hw_params_set_format(d.h, hwParams, C.snd_pcm_format_t(nearest))
+			d.adjust("format", int(format), int(nearest))
+			format = nearest
+		}
+	}
 	if ret < 0 {
 		return createError("could not set format params", ret)
 	}
+	if options.ChannelsAuto {
+		var max C.uint
+		ret = C.snd_pcm_hw_params_get_channels_max(hwParams, &max)
+		if ret < 0 {
+			return createError("could not get channels max", ret)
+		}
+		channels = int(max)
+	}
 	ret = C.snd_pcm_hw_params_set_channels(d.h, hwParams, C.uint(channels))
+	if ret < 0 && (options.FallbackToNear || options.FallbackChannels) {
+		var near = C.uint(channels)
+		ret = C.snd_pcm_hw_params_set_channels_near(d.h, hwParams, &near)
+		d.adjust("channels", channels, int(near))
+		channels = int(near)
+	}
 	if ret < 0 {
 		return createError("could not set channels params", ret)
 	}
 	ret = C.snd_pcm_hw_params_set_rate(d.h, hwParams, C.uint(rate), 0)
+	if ret < 0 && options.FallbackToNear {
+		var near = C.uint(rate)
+		ret = C.snd_pcm_hw_params_set_rate_near(d.h, hwParams, &near, nil)
+		d.adjust("rate", rate, int(near))
+		rate = int(near)
+	}
 	if ret < 0 {
 		return createError("could not set rate params", ret)
 	}
@@ -123,10 +420,19 @@ func (d *device) createDevice(deviceName string, channels int, format Format, ra
 			return createError("could not get buffer size", ret)
 		}
 	}
-	ret = C.snd_pcm_hw_params_set_buffer_size_near(d.h, hwParams, &bufferSize)
+	ret = -1
+	if options.FallbackToNear {
+		ret = C.snd_pcm_hw_params_set_buffer_size(d.h, hwParams, bufferSize)
+	}
+	if ret < 0 {
+		ret = C.snd_pcm_hw_params_set_buffer_size_near(d.h, hwParams, &bufferSize)
+	}
 	if ret < 0 {
 		return createError("could not set buffer size", ret)
 	}
+	if bufferParams.BufferFrames > 0 {
+		d.adjust("buffer frames", bufferParams.BufferFrames, int(bufferSize))
+	}
 	// Default period size: 1/8 of a second
 	var periodFrames = C.snd_pcm_uframes_t(rate / 8)
 	if bufferParams.PeriodFrames > 0 {
@@ -134,10 +440,23 @@ func (d *device) createDevice(deviceName string, channels int, format Format, ra
 	} else if bufferParams.Periods > 0 {
 		periodFrames = C.snd_pcm_uframes_t(int(bufferSize) / bufferParams.Periods)
 	}
-	ret = C.snd_pcm_hw_params_set_period_size_near(d.h, hwParams, &periodFrames, nil)
+	if bufferParams.PowerOfTwoPeriod {
+		periodFrames = powerOfTwoPeriod(d.h, hwParams, periodFrames)
+	}
+	var requestedPeriod = periodFrames
+	ret = -1
+	if options.FallbackToNear {
+		ret = C.snd_pcm_hw_params_set_period_size(d.h, hwParams, periodFrames, 0)
+	}
+	if ret < 0 {
+		ret = C.snd_pcm_hw_params_set_period_size_near(d.h, hwParams, &periodFrames, nil)
+	}
 	if ret < 0 {
 		return createError("could not set period size", ret)
 	}
+	if bufferParams.PeriodFrames > 0 || bufferParams.Periods > 0 {
+		d.adjust("period frames", int(requestedPeriod), int(periodFrames))
+	}
 	var periods = C.uint(0)
 	ret = C.snd_pcm_hw_params_get_periods(hwParams, &periods, nil)
 	if ret < 0 {
@@ -154,13 +473,169 @@ func (d *device) createDevice(deviceName string, channels int, format Format, ra
 	d.BufferParams.BufferFrames = int(bufferSize)
 	d.BufferParams.PeriodFrames = int(periodFrames)
 	d.BufferParams.Periods = int(periods)
+	d.chunkFrames = int(bufferSize)
+	if options.ChunkFrames > 0 {
+		d.chunkFrames = options.ChunkFrames
+	}
+	if bufferParams.StartWhenFull {
+		err = d.setStartThreshold(int(bufferSize))
+		if err != nil {
+			return err
+		}
+		d.BufferParams.StartWhenFull = true
+	}
+	d.BufferParams.PowerOfTwoPeriod = bufferParams.PowerOfTwoPeriod
+	d.BufferParams.ExportBuffer = bufferParams.ExportBuffer
+	if options.LatencyWarning > 0 && d.EstimatedLatency() > options.LatencyWarning {
+		log.Printf("alsa: %s buffer of %d frames gives %v latency", deviceName,
+			d.BufferParams.BufferFrames, d.EstimatedLatency())
+	}
 	return
 }
 
-// Close closes a device and frees the resources associated with it.
+func (d *device) lock() {
+	if d.mu != nil {
+		d.mu.Lock()
+	}
+}
+
+func (d *device) unlock() {
+	if d.mu != nil {
+		d.mu.Unlock()
+	}
+}
+
+// adjust records a parameter if the granted value differs from the
+// requested one.
+func (d *device) adjust(param string, requested, granted int) {
+	if requested != granted {
+		d.adjustments = append(d.adjustments, ParamAdjustment{param, requested, granted})
+	}
+}
+
+// Adjustments returns the parameters which the hardware did not grant as
+// requested when the device was created.
+func (d *device) Adjustments() []ParamAdjustment {
+	return d.adjustments
+}
+
+// ConfigReport returns the configuration requested for the device alongside
+// the one granted after negotiating with the hardware.
+func (d *device) ConfigReport() ConfigReport {
+	return ConfigReport{
+		Requested: d.requested,
+		Granted: DeviceConfig{
+			Access:       interleavedAccess,
+			Format:       d.Format,
+			Rate:         d.Rate,
+			Channels:     d.Channels,
+			BufferFrames: d.BufferParams.BufferFrames,
+			PeriodFrames: d.BufferParams.PeriodFrames,
+			Periods:      d.BufferParams.Periods,
+		},
+	}
+}
+
+// powerOfTwoPeriod returns the largest power of two period size no larger
+// than target which the hardware accepts, or target if there is none.
+func powerOfTwoPeriod(h *C.snd_pcm_t, hwParams *C.snd_pcm_hw_params_t, target C.snd_pcm_uframes_t) C.snd_pcm_uframes_t {
+	size := C.snd_pcm_uframes_t(1)
+	for size*2 <= target {
+		size *= 2
+	}
+	for ; size > 0 && size <= target; size /= 2 {
+		if C.snd_pcm_hw_params_test_period_size(h, hwParams, size, 0) == 0 {
+			return size
+		}
+	}
+	return target
+}
+
+// nearestFormat returns the supported format closest to the requested one,
+// as ranked by closestFormat.
+func nearestFormat(h *C.snd_pcm_t, hwParams *C.snd_pcm_hw_params_t, requested Format) (nearest Format, ok bool) {
+	var supported []Format
+	for _, format := range allFormats {
+		if C.snd_pcm_hw_params_test_format(h, hwParams, C.snd_pcm_format_t(format)) == 0 {
+			supported = append(supported, format)
+		}
+	}
+	return closestFormat(requested, supported)
+}
+
+// createDeviceSimple configures a device using the simplified
+// snd_pcm_set_params interface, which picks the buffer and period sizes to
+// suit the requested latency.
+func (d *device) createDeviceSimple(deviceName string, format Format, channels, rate int, playback bool, softResample bool, latencyUs int) (err error) {
+	d.requested = DeviceConfig{
+		Access:   interleavedAccess,
+		Format:   format,
+		Rate:     rate,
+		Channels: channels,
+	}
+	err = d.open(deviceName, playback, DeviceOptions{})
+	if err != nil {
+		return err
+	}
+	var resample C.int
+	if softResample {
+		resample = 1
+	}
+	ret := C.snd_pcm_set_params(d.h, C.snd_pcm_format_t(format), C.SND_PCM_ACCESS_RW_INTERLEAVED,
+		C.uint(channels), C.uint(rate), resample, C.uint(latencyUs))
+	if ret < 0 {
+		return createError("could not set params", ret)
+	}
+	var bufferSize, periodFrames C.snd_pcm_uframes_t
+	ret = C.snd_pcm_get_params(d.h, &bufferSize, &periodFrames)
+	if ret < 0 {
+		return createError("could not get params", ret)
+	}
+	d.frames = int(periodFrames)
+	d.Channels = channels
+	d.Format = format
+	d.Rate = rate
+	d.BufferParams.BufferFrames = int(bufferSize)
+	d.BufferParams.PeriodFrames = int(periodFrames)
+	if periodFrames > 0 {
+		d.BufferParams.Periods = int(bufferSize / periodFrames)
+	}
+	d.chunkFrames = int(bufferSize)
+	return
+}
+
+// Close closes a device and frees the resources associated with it. Whether
+// audio still queued is played first depends on the ClosePolicy.
 func (d *device) Close() {
+	d.close(d.closePolicy != ClosePolicyDrop)
+}
+
+// CloseNow closes a device without waiting for pending audio to play,
+// discarding it instead.
+func (d *device) CloseNow() {
+	d.close(false)
+}
+
+func (d *device) close(drain bool) {
+	atomic.StoreInt32(&d.closing, 1)
+	d.lock()
+	defer d.unlock()
+	if d.ring != nil {
+		d.ring.stop()
+		d.ring = nil
+	}
 	if d.h != nil {
-		C.snd_pcm_drain(d.h)
+		if drain && d.closePolicy == ClosePolicyAuto {
+			switch C.snd_pcm_state(d.h) {
+			case C.SND_PCM_STATE_XRUN, C.SND_PCM_STATE_SUSPENDED, C.SND_PCM_STATE_DISCONNECTED:
+				drain = false
+			}
+		}
+		if drain {
+			C.snd_pcm_drain(d.h)
+		} else {
+			C.snd_pcm_drop(d.h)
+		}
 		C.snd_pcm_close(d.h)
 		d.h = nil
 	}
@@ -171,6 +646,222 @@ func (d *device) Close() {
 	runtime.SetFinalizer(d, nil)
 }
 
+// Prepare prepares the device for use, for example to restart it after it
+// has been stopped.
+func (d *device) Prepare() error {
+	d.lock()
+	defer d.unlock()
+	if d.h == nil {
+		return ErrClosed
+	}
+	ret := C.snd_pcm_prepare(d.h)
+	if ret < 0 {
+		return createError("could not prepare device", ret)
+	}
+	return nil
+}
+
+// EstimatedLatency returns the latency implied by the buffer size, the time
+// taken to play or capture a full buffer.
+func (d *device) EstimatedLatency() time.Duration {
+	if d.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(d.BufferParams.BufferFrames) * time.Second / time.Duration(d.Rate)
+}
+
+// MeasuredLatency returns the latency reported by the driver for a running
+// device, the time until a frame written now is played or since a frame
+// ready to read was captured.
+func (d *device) MeasuredLatency() (time.Duration, error) {
+	d.lock()
+	defer d.unlock()
+	if d.h == nil {
+		return 0, ErrClosed
+	}
+	if State(C.snd_pcm_state(d.h)) != StateRunning {
+		return 0, errors.New("latency can only be measured while the device is running")
+	}
+	var delay C.snd_pcm_sframes_t
+	ret := C.snd_pcm_delay(d.h, &delay)
+	if ret < 0 {
+		return 0, createError("could not get delay", ret)
+	}
+	if d.Rate <= 0 || delay < 0 {
+		return 0, nil
+	}
+	return time.Duration(delay) * time.Second / time.Duration(d.Rate), nil
+}
+
+// countXrun records an underrun for a playback device or an overrun for a
+// capture device.
+func (d *device) countXrun() {
+	if C.snd_pcm_stream(d.h) == C.SND_PCM_STREAM_PLAYBACK {
+		atomic.AddUint32(&d.underruns, 1)
+	} else {
+		atomic.AddUint32(&d.overruns, 1)
+	}
+}
+
+// Underruns returns the number of underruns the device has recovered from.
+func (d *device) Underruns() int {
+	return int(atomic.LoadUint32(&d.underruns))
+}
+
+// Overruns returns the number of overruns the device has recovered from.
+func (d *device) Overruns() int {
+	return int(atomic.LoadUint32(&d.overruns))
+}
+
+// Handle returns the underlying snd_pcm_t of the device, for calling ALSA
+// functions which are not otherwise wrapped. It is nil once the device is
+// closed. The handle remains owned by the device and must not be closed
+// directly.
+func (d *device) Handle() unsafe.Pointer {
+	return unsafe.Pointer(d.h)
+}
+
+// PeriodBytes returns the size in bytes of one period of audio.
+func (d *device) PeriodBytes() int {
+	return d.BufferParams.PeriodFrames * d.Channels * d.formatSampleSize()
+}
+
+// Reset discards the frames queued in the device buffer, reducing the delay
+// to zero, while keeping the device configuration and state.
+func (d *device) Reset() error {
+	d.lock()
+	defer d.unlock()
+	if d.h == nil {
+		return ErrClosed
+	}
+	ret := C.snd_pcm_reset(d.h)
+	if ret < 0 {
+		return createError("could not reset device", ret)
+	}
+	return nil
+}
+
+// State returns the current state of the device.
+func (d *device) State() (State, error) {
+	d.lock()
+	defer d.unlock()
+	if d.h == nil {
+		return StateOpen, ErrClosed
+	}
+	return State(C.snd_pcm_state(d.h)), nil
+}
+
+// IsXrun reports whether the device has stopped because of an overrun or
+// underrun and needs preparing before it can be used again.
+func (d *device) IsXrun() (bool, error) {
+	state, err := d.State()
+	if err != nil {
+		return false, err
+	}
+	return state == StateXrun, nil
+}
+
+// WaitRunning waits until the device is running or the timeout expires.
+func (d *device) WaitRunning(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := d.State()
+		if err != nil {
+			return err
+		}
+		if state == StateRunning {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return errors.New("timed out waiting for device to start running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// WaitReady waits until the device is ready to be read from or written to,
+// or the timeout expires, in which case it returns false. A negative
+// timeout waits forever. If the device has overrun, underrun or been
+// suspended it is recovered and reported as ready, rather than returning
+// an error.
+func (d *device) WaitReady(timeout time.Duration) (ready bool, err error) {
+	d.lock()
+	defer d.unlock()
+	if d.h == nil {
+		return false, ErrClosed
+	}
+	timeoutMs := -1
+	if timeout >= 0 {
+		timeoutMs = int(timeout / time.Millisecond)
+	}
+	ret := d.pcm().wait(d.h, timeoutMs)
+	if ret == -C.EPIPE || ret == -C.ESTRPIPE {
+		// An xrun or suspend does not clear until the device is recovered,
+		// so waiting again without recovering would fail forever
+		if ret == -C.EPIPE {
+			d.countXrun()
+		}
+		rc := C.snd_pcm_recover(d.h, C.int(ret), 1)
+		if rc < 0 {
+			return false, createError("could not recover device", rc)
+		}
+		return true, nil
+	} else if ret < 0 {
+		return false, createError("wait error", C.int(ret))
+	}
+	return ret > 0, nil
+}
+
+func (d *device) startThreshold() (frames int, err error) {
+	var swParams *C.snd_pcm_sw_params_t
+	ret := C.snd_pcm_sw_params_malloc(&swParams)
+	if ret < 0 {
+		return 0, createError("could not alloc sw params", ret)
+	}
+	defer C.snd_pcm_sw_params_free(swParams)
+	ret = C.snd_pcm_sw_params_current(d.h, swParams)
+	if ret < 0 {
+		return 0, createError("could not get sw params", ret)
+	}
+	var threshold C.snd_pcm_uframes_t
+	ret = C.snd_pcm_sw_params_get_start_threshold(swParams, &threshold)
+	if ret < 0 {
+		return 0, createError("could not get start threshold", ret)
+	}
+	return int(threshold), nil
+}
+
+// setStartThreshold sets the start threshold of the device, a negative
+// value disables automatic starting altogether.
+func (d *device) setStartThreshold(frames int) (err error) {
+	var swParams *C.snd_pcm_sw_params_t
+	ret := C.snd_pcm_sw_params_malloc(&swParams)
+	if ret < 0 {
+		return createError("could not alloc sw params", ret)
+	}
+	defer C.snd_pcm_sw_params_free(swParams)
+	ret = C.snd_pcm_sw_params_current(d.h, swParams)
+	if ret < 0 {
+		return createError("could not get sw params", ret)
+	}
+	var threshold = C.snd_pcm_uframes_t(frames)
+	if frames < 0 {
+		ret = C.snd_pcm_sw_params_get_boundary(swParams, &threshold)
+		if ret < 0 {
+			return createError("could not get boundary", ret)
+		}
+	}
+	ret = C.snd_pcm_sw_params_set_start_threshold(d.h, swParams, threshold)
+	if ret < 0 {
+		return createError("could not set start threshold", ret)
+	}
+	ret = C.snd_pcm_sw_params(d.h, swParams)
+	if ret < 0 {
+		return createError("could not set sw params", ret)
+	}
+	return
+}
+
 func (d device) formatSampleSize() (s int) {
 	switch d.Format {
 	case FormatS8, FormatU8:
@@ -185,15 +876,43 @@ func (d device) formatSampleSize() (s int) {
 	panic("unsupported format")
 }
 
+// newBuffer allocates a slice with the given number of samples whose
+// element type matches the device format.
+func (d device) newBuffer(samples int) interface{} {
+	switch d.Format {
+	case FormatFloatLE, FormatFloatBE:
+		return make([]float32, samples)
+	case FormatFloat64LE, FormatFloat64BE:
+		return make([]float64, samples)
+	}
+	switch d.formatSampleSize() {
+	case 1:
+		return make([]int8, samples)
+	case 2:
+		return make([]int16, samples)
+	case 4:
+		return make([]int32, samples)
+	}
+	panic("unsupported format")
+}
+
 // CaptureDevice is an ALSA device configured to record audio.
 type CaptureDevice struct {
 	device
+	// captureMu serialises the reads made by Capture with Close.
+	captureMu sync.Mutex
 }
 
 // NewCaptureDevice creates a new CaptureDevice object.
 func NewCaptureDevice(deviceName string, channels int, format Format, rate int, bufferParams BufferParams) (c *CaptureDevice, err error) {
+	return NewCaptureDeviceWithOptions(deviceName, channels, format, rate, bufferParams, DeviceOptions{})
+}
+
+// NewCaptureDeviceWithOptions creates a new CaptureDevice object with the
+// given options.
+func NewCaptureDeviceWithOptions(deviceName string, channels int, format Format, rate int, bufferParams BufferParams, options DeviceOptions) (c *CaptureDevice, err error) {
 	c = new(CaptureDevice)
-	err = c.createDevice(deviceName, channels, format, rate, false, bufferParams)
+	err = c.createDevice(deviceName, channels, format, rate, false, bufferParams, options)
 	if err != nil {
 		return nil, err
 	}
@@ -204,7 +923,10 @@ func (c *CaptureDevice) StartReadThread() error {
 	if c.readerThread != nil {
 		return errors.New("Reader thread already running")
 	}
-	periodBytes := C.int(c.formatSampleSize() * c.Channels * c.BufferParams.PeriodFrames)
+	if c.ring != nil {
+		return errors.New("ring buffer already running")
+	}
+	periodBytes := C.int(c.PeriodBytes())
 	// Alocate a 1 second buffer
 	nbuf := C.int(c.Rate / c.BufferParams.PeriodFrames)
 	c.readerThread = C.reader_thread_start(c.h, periodBytes, C.int(c.BufferParams.PeriodFrames), nbuf)
@@ -216,6 +938,12 @@ func (c *CaptureDevice) StartReadThread() error {
 
 // Read reads samples into a buffer and returns the amount read.
 func (c *CaptureDevice) Read(buffer interface{}) (samples int, err error) {
+	c.lock()
+	defer c.unlock()
+	if c.h == nil {
+		return 0, ErrClosed
+	}
+
 	bufferType := reflect.TypeOf(buffer)
 	if !(bufferType.Kind() == reflect.Array ||
 		bufferType.Kind() == reflect.Slice) {
@@ -251,48 +979,168 @@ func (c *CaptureDevice) Read(buffer interface{}) (samples int, err error) {
 	frames := length / c.Channels
 	bufPtr := unsafe.Pointer(sliceData.Index(0).Addr().Pointer())
 
+	frames, err = c.readFrames(bufPtr, frames)
+	if err != nil {
+		return 0, err
+	}
+	samples = frames * c.Channels
+	return
+}
+
+// readFrames reads frames into a buffer in the device format and returns
+// the number of frames read.
+func (c *CaptureDevice) readFrames(bufPtr unsafe.Pointer, frames int) (read int, err error) {
+	if c.ring != nil {
+		size := frames * c.Channels * c.formatSampleSize()
+		err = c.ring.read((*[1 << 30]byte)(bufPtr)[:size:size])
+		if err != nil {
+			return 0, err
+		}
+		return frames, nil
+	}
 	if c.readerThread != nil {
 		if frames != c.BufferParams.PeriodFrames {
 			return 0, errors.New("buffer size must match period")
 		}
 		rc := C.reader_thread_poll(c.readerThread, bufPtr)
 		if rc == 1 {
+			c.countXrun()
 			return 0, ErrOverrun
 		} else if rc != 0 {
 			return 0, fmt.Errorf("read error: %s", C.GoString(C.reader_thread_error))
 		}
-		samples = frames * c.Channels
-	} else {
-		ret := C.snd_pcm_readi(c.h, bufPtr, C.snd_pcm_uframes_t(frames))
+		return frames, nil
+	}
+	ret := C.snd_pcm_readi(c.h, bufPtr, C.snd_pcm_uframes_t(frames))
 
-		if ret == -C.EPIPE {
-			C.snd_pcm_prepare(c.h)
-			return 0, ErrOverrun
-		} else if ret < 0 {
-			return 0, createError("read error", C.int(ret))
+	if ret == -C.EPIPE {
+		c.countXrun()
+		C.snd_pcm_prepare(c.h)
+		return 0, ErrOverrun
+	} else if ret < 0 {
+		return 0, createError("read error", C.int(ret))
+	}
+	return int(ret), nil
+}
+
+// ReadFrames allocates a buffer of the given number of frames, reads into it
+// and returns it trimmed to the samples actually read. The buffer is a slice
+// of int8, int16, int32, float32 or float64 depending on the device format.
+func (c *CaptureDevice) ReadFrames(frames int) (buffer interface{}, err error) {
+	if frames <= 0 {
+		return nil, errors.New("frames must be positive")
+	}
+	buffer = c.newBuffer(frames * c.Channels)
+	samples, err := c.Read(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(buffer).Slice(0, samples).Interface(), nil
+}
+
+// Capture repeatedly reads a period of audio and passes it to handler along
+// with the number of frames read. Overruns are recovered from and skipped.
+// Capture returns nil when the handler returns ErrStop or the device is
+// closed, otherwise it returns the first error from the handler or device.
+// The device may be closed from another goroutine to stop Capture, in which
+// case it is closed once the current read completes. The buffer is reused
+// so the handler must not retain it.
+func (c *CaptureDevice) Capture(handler func(buf interface{}, frames int) error) error {
+	buffer := c.newBuffer(c.BufferParams.PeriodFrames * c.Channels)
+	val := reflect.ValueOf(buffer)
+	for {
+		if atomic.LoadInt32(&c.closing) != 0 {
+			return nil
+		}
+		c.captureMu.Lock()
+		samples, err := c.Read(buffer)
+		c.captureMu.Unlock()
+		if err == ErrOverrun {
+			continue
+		} else if err == ErrClosed {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = handler(val.Slice(0, samples).Interface(), samples/c.Channels)
+		if err == ErrStop {
+			return nil
+		} else if err != nil {
+			return err
 		}
-		samples = int(ret) * c.Channels
 	}
-	return
+}
+
+// Close waits for any read by Capture to complete, then closes the device
+// and frees the resources associated with it.
+func (c *CaptureDevice) Close() {
+	atomic.StoreInt32(&c.closing, 1)
+	c.captureMu.Lock()
+	defer c.captureMu.Unlock()
+	c.device.Close()
+}
+
+// CloseNow waits for any read by Capture to complete, then closes the
+// device without waiting for pending audio.
+func (c *CaptureDevice) CloseNow() {
+	atomic.StoreInt32(&c.closing, 1)
+	c.captureMu.Lock()
+	defer c.captureMu.Unlock()
+	c.device.CloseNow()
 }
 
 // PlaybackDevice is an ALSA device configured to playback audio.
 type PlaybackDevice struct {
 	device
+	// writeMu serialises writes to the device with the auto silence worker.
+	writeMu sync.Mutex
+	// silenceMu guards the auto silence worker's channels and count
+	silenceMu     sync.Mutex
+	silenceFrames int
+	silenceStop   chan struct{}
+	silenceDone   chan struct{}
+	// scratch is reused between calls which convert samples before writing
+	scratch []byte
 }
 
 // NewPlaybackDevice creates a new PlaybackDevice object.
 func NewPlaybackDevice(deviceName string, channels int, format Format, rate int, bufferParams BufferParams) (p *PlaybackDevice, err error) {
+	return NewPlaybackDeviceWithOptions(deviceName, channels, format, rate, bufferParams, DeviceOptions{})
+}
+
+// NewPlaybackDeviceWithOptions creates a new PlaybackDevice object with the
+// given options.
+func NewPlaybackDeviceWithOptions(deviceName string, channels int, format Format, rate int, bufferParams BufferParams, options DeviceOptions) (p *PlaybackDevice, err error) {
 	p = new(PlaybackDevice)
-	err = p.createDevice(deviceName, channels, format, rate, true, bufferParams)
+	err = p.createDevice(deviceName, channels, format, rate, true, bufferParams, options)
 	if err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
-// Write writes a buffer of data to a playback device.
+// NewPlaybackDeviceSimple creates a new PlaybackDevice object configured
+// for the given latency in microseconds, leaving the choice of buffer and
+// period sizes to ALSA. If softResample is set ALSA resamples in software
+// when the hardware does not support the rate.
+func NewPlaybackDeviceSimple(deviceName string, format Format, channels, rate int, softResample bool, latencyUs int) (p *PlaybackDevice, err error) {
+	p = new(PlaybackDevice)
+	err = p.createDeviceSimple(deviceName, format, channels, rate, true, softResample, latencyUs)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Write writes a buffer of data to a playback device. If an error occurs
+// the number of samples written before it is returned with the error.
 func (p *PlaybackDevice) Write(buffer interface{}) (samples int, err error) {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return 0, ErrClosed
+	}
+
 	bufferType := reflect.TypeOf(buffer)
 	if !(bufferType.Kind() == reflect.Array ||
 		bufferType.Kind() == reflect.Slice) {
@@ -325,16 +1173,212 @@ func (p *PlaybackDevice) Write(buffer interface{}) (samples int, err error) {
 	length := val.Len()
 	sliceData := val.Slice(0, length)
 
-	var frames = C.snd_pcm_uframes_t(length / p.Channels)
+	frames := length / p.Channels
 	bufPtr := unsafe.Pointer(sliceData.Index(0).Addr().Pointer())
 
-	ret := C.snd_pcm_writei(p.h, bufPtr, frames)
-	if ret == -C.EPIPE {
-		C.snd_pcm_prepare(p.h)
-		return 0, ErrUnderrun
-	} else if ret < 0 {
-		return 0, createError("write error", C.int(ret))
+	// Report frames already played along with any error, so that a
+	// retry does not repeat them
+	frames, err = p.writeFrames(bufPtr, frames)
+	samples = frames * p.Channels
+	return
+}
+
+// WriteAll writes the whole of a buffer of samples to a playback device,
+// waiting for room in the device buffer whenever ALSA accepts only part of
+// it. Buffers use the same sample types as Write. An underrun is recovered
+// from and the remaining audio resent; ErrUnderrun is only returned if the
+// resend underruns again without any progress.
+func (p *PlaybackDevice) WriteAll(buffer interface{}) error {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return ErrClosed
+	}
+	buf, err := bufferBytes(buffer, p.formatSampleSize())
+	if err != nil {
+		return err
+	}
+	_, err = p.writeAll(buf)
+	return err
+}
+
+// writeAll writes all the whole frames in a buffer in the device format,
+// as described for WriteAll, and returns the number of frames written.
+func (p *PlaybackDevice) writeAll(buf []byte) (written int, err error) {
+	frameBytes := p.Channels * p.formatSampleSize()
+	frames := len(buf) / frameBytes
+	recovering := false
+	for written < frames {
+		n, err := p.writeFrames(unsafe.Pointer(&buf[written*frameBytes]), frames-written)
+		written += n
+		if err == ErrUnderrun {
+			if recovering && n == 0 {
+				return written, ErrUnderrun
+			}
+			recovering = true
+			continue
+		} else if err != nil {
+			return written, err
+		}
+		recovering = false
+		if written < frames {
+			ret := p.pcm().wait(p.h, -1)
+			if ret < 0 && ret != -C.EPIPE && ret != -C.ESTRPIPE {
+				return written, createError("wait error", C.int(ret))
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeFrames writes frames from a buffer already in the device format and
+// returns the number of frames written. Large buffers are written in chunks
+// of at most chunkFrames, stopping with ErrClosed between chunks once Close
+// has been called.
+func (p *PlaybackDevice) writeFrames(bufPtr unsafe.Pointer, frames int) (written int, err error) {
+	frameBytes := uintptr(p.Channels * p.formatSampleSize())
+	for written < frames {
+		if atomic.LoadInt32(&p.closing) != 0 {
+			return written, ErrClosed
+		}
+		chunk := frames - written
+		if p.chunkFrames > 0 && chunk > p.chunkFrames {
+			chunk = p.chunkFrames
+		}
+		chunkPtr := unsafe.Pointer(uintptr(bufPtr) + uintptr(written)*frameBytes)
+		p.writeMu.Lock()
+		ret := p.pcm().writei(p.h, chunkPtr, chunk)
+		p.writeMu.Unlock()
+		if ret == -C.EPIPE {
+			p.countXrun()
+			C.snd_pcm_prepare(p.h)
+			return written, ErrUnderrun
+		} else if ret < 0 {
+			return written, createError("write error", C.int(ret))
+		}
+		written += ret
+		if ret < chunk {
+			break
+		}
+	}
+	return written, nil
+}
+
+// writeSilence writes the given number of frames of silence to the device.
+func (p *PlaybackDevice) writeSilence(frames int) (err error) {
+	if frames <= 0 {
+		return
+	}
+	samples := frames * p.Channels
+	silence := make([]byte, samples*p.formatSampleSize())
+	bufPtr := unsafe.Pointer(&silence[0])
+	C.snd_pcm_format_set_silence(C.snd_pcm_format_t(p.Format), bufPtr, C.uint(samples))
+
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	for frames > 0 {
+		ret := C.snd_pcm_writei(p.h, bufPtr, C.snd_pcm_uframes_t(frames))
+		if ret == -C.EPIPE {
+			p.countXrun()
+			C.snd_pcm_prepare(p.h)
+			return ErrUnderrun
+		} else if ret < 0 {
+			return createError("write error", C.int(ret))
+		}
+		frames -= int(ret)
 	}
-	samples = int(ret) * p.Channels
 	return
 }
+
+// SeekReset discards the audio queued in the device, prepares it and
+// queues preroll worth of silence, so that playback from a new position
+// resumes without a click or an immediate underrun. The preroll is limited
+// to the buffer size.
+func (p *PlaybackDevice) SeekReset(preroll time.Duration) error {
+	if preroll < 0 {
+		return errors.New("preroll must not be negative")
+	}
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return ErrClosed
+	}
+	ret := C.snd_pcm_drop(p.h)
+	if ret < 0 {
+		return createError("could not drop device", ret)
+	}
+	ret = C.snd_pcm_prepare(p.h)
+	if ret < 0 {
+		return createError("could not prepare device", ret)
+	}
+	frames := int(preroll * time.Duration(p.Rate) / time.Second)
+	if frames > p.BufferParams.BufferFrames {
+		frames = p.BufferParams.BufferFrames
+	}
+	return p.writeSilence(frames)
+}
+
+// Drain waits for the audio queued in the device to play and then stops
+// it. The device remains open and may be restarted with Prepare.
+func (p *PlaybackDevice) Drain() error {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return ErrClosed
+	}
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	ret := C.snd_pcm_drain(p.h)
+	if ret < 0 {
+		return createError("could not drain device", ret)
+	}
+	return nil
+}
+
+// Drop stops the device immediately, discarding the audio queued in it.
+// The device remains open and may be restarted with Prepare.
+func (p *PlaybackDevice) Drop() error {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return ErrClosed
+	}
+	ret := C.snd_pcm_drop(p.h)
+	if ret < 0 {
+		return createError("could not drop device", ret)
+	}
+	return nil
+}
+
+// Pause pauses or resumes playback, keeping the audio queued in the
+// device. It returns ErrPauseUnsupported if the hardware cannot pause, in
+// which case Drop may be used instead.
+func (p *PlaybackDevice) Pause(enable bool) error {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return ErrClosed
+	}
+	var hwParams *C.snd_pcm_hw_params_t
+	ret := C.snd_pcm_hw_params_malloc(&hwParams)
+	if ret < 0 {
+		return createError("could not alloc hw params", ret)
+	}
+	defer C.snd_pcm_hw_params_free(hwParams)
+	ret = C.snd_pcm_hw_params_current(p.h, hwParams)
+	if ret < 0 {
+		return createError("could not get hw params", ret)
+	}
+	if C.snd_pcm_hw_params_can_pause(hwParams) == 0 {
+		return ErrPauseUnsupported
+	}
+	var pause C.int
+	if enable {
+		pause = 1
+	}
+	ret = C.snd_pcm_pause(p.h, pause)
+	if ret < 0 {
+		return createError("could not pause device", ret)
+	}
+	return nil
+}
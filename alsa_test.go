@@ -5,8 +5,17 @@
 package alsa
 
 import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
+	"github.com/cocoonlife/goalsa/alsatest"
 	"github.com/cocoonlife/testify/assert"
 )
 
@@ -52,6 +61,17 @@ func TestCapture(t *testing.T) {
 	a.NoError(err, "read samples ok")
 	a.Equal(len(b2), samples, "correct number of samples read")
 
+	b5, err := c.ReadFrames(50)
+
+	a.NoError(err, "read frames ok")
+	a.Len(b5, 50, "correct number of samples read")
+	_, ok := b5.([]int32)
+	a.True(ok, "buffer matches format")
+
+	_, err = c.ReadFrames(0)
+
+	a.Error(err, "no frames error")
+
 	c.Close()
 }
 
@@ -98,6 +118,1163 @@ func TestPlayback(t *testing.T) {
 
 	a.NoError(err, "buffer written ok")
 	a.Equal(frames, 100, "100 frames written")
+	alsatest.AssertNoXruns(t, p)
+
+	a.NoError(p.Prepare(), "device prepared")
+
+	state, err := p.State()
+
+	a.NoError(err, "got state")
+	a.Equal(state, State(StatePrepared), "device is prepared")
+
+	xrun, err := p.IsXrun()
+
+	a.NoError(err, "got xrun state")
+	a.False(xrun, "device is not in xrun")
+	a.Error(p.WaitRunning(10*time.Millisecond), "timed out waiting")
+
+	_, err = p.Write(b4)
+
+	a.NoError(err, "buffer written ok")
+	a.NoError(p.WaitRunning(time.Second), "device is running")
+
+	p.Close()
+
+	a.Equal(p.Prepare(), ErrClosed, "device is closed")
+}
+
+func TestAutoSilence(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 44100,
+		BufferParams{PeriodFrames: 441})
+
+	a.NoError(err, "created playback device")
+
+	a.NoError(p.EnableAutoSilence(), "auto silence enabled")
+	a.Error(p.EnableAutoSilence(), "auto silence already enabled")
+
+	_, err = p.Write(make([]int32, 100))
+
+	a.NoError(err, "buffer written ok")
+
+	// The null device always has room, so the worker tops it up every
+	// half period; wait for ten periods
+	time.Sleep(100 * time.Millisecond)
+	p.DisableAutoSilence()
+
+	a.True(p.SilenceFrames() > 0, "silence inserted")
+	a.Equal(p.Underruns(), 0, "no underruns")
+
+	p.Close()
+
+	a.Error(p.EnableAutoSilence(), "device is closed")
+
+	// Concurrent closes of a shared device stop the worker once
+	p, err = NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 44100,
+		BufferParams{}, DeviceOptions{ThreadSafe: true})
+
+	a.NoError(err, "created thread safe playback device")
+	a.NoError(p.EnableAutoSilence(), "auto silence enabled")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Close()
+		}()
+	}
+	wg.Wait()
+
+	a.Error(p.EnableAutoSilence(), "device is closed")
+}
+
+func TestSynchronizedStart(t *testing.T) {
+	a := assert.New(t)
+
+	a.Error(SynchronizedStart(), "no devices error")
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 44100,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	a.Error(LinkDevices(p), "too few devices error")
+	a.NoError(SynchronizedStart(p), "device started")
+
+	p.Close()
+
+	a.Equal(SynchronizedStart(p), ErrClosed, "device is closed")
+}
+
+func TestSynchronizedStartGroup(t *testing.T) {
+	a := assert.New(t)
+
+	// The null PCM cannot be linked, so simulate the kernel link groups,
+	// which refuse to link a device that is already linked
+	ops := defaultPCMOps
+	linked := make(map[pcmHandle]bool)
+	var failLink pcmHandle
+	ops.link = func(h1, h2 pcmHandle) int {
+		if h2 == failLink {
+			return -int(syscall.EINVAL)
+		}
+		if linked[h2] {
+			return -int(syscall.EALREADY)
+		}
+		linked[h1], linked[h2] = true, true
+		return 0
+	}
+	ops.unlink = func(h pcmHandle) int {
+		if !linked[h] {
+			return -int(syscall.EALREADY)
+		}
+		delete(linked, h)
+		return 0
+	}
+
+	devices := make([]*PlaybackDevice, 3)
+	for i := range devices {
+		p, err := NewPlaybackDevice("null", 1, FormatS32LE, 44100,
+			BufferParams{})
+
+		a.NoError(err, "created playback device")
+		p.ops = &ops
+		devices[i] = p
+	}
+
+	a.NoError(SynchronizedStart(devices[:2]...), "devices started")
+	a.True(linked[devices[0].h] && linked[devices[1].h], "devices linked")
+	a.NoError(SynchronizedStart(devices[:2]...), "linked devices started again")
+
+	a.NoError(UnlinkDevices(devices...), "devices unlinked")
+
+	failLink = devices[2].h
+
+	a.Error(LinkDevices(devices...), "link error")
+	a.Len(linked, 0, "devices unlinked after link error")
+
+	for _, p := range devices {
+		p.Close()
+	}
+}
+
+func TestThreadSafe(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 44100,
+		BufferParams{}, DeviceOptions{ThreadSafe: true})
+
+	a.NoError(err, "created playback device")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			frames, err := p.Write(make([]int32, 100))
+			a.NoError(err, "buffer written ok")
+			a.Equal(frames, 100, "100 frames written")
+		}()
+	}
+	wg.Wait()
+
+	p.Close()
+
+	_, err = p.Write(make([]int32, 100))
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+func TestListSubdevices(t *testing.T) {
+	a := assert.New(t)
+
+	subdevices, err := ListSubdevices(99, 0)
+
+	a.Error(err, "no card error")
+	a.Len(subdevices, 0, "no subdevices")
+
+	cards, err := ListCards()
+
+	a.NoError(err, "listed cards")
+	for _, card := range cards {
+		_, err = ListSubdevices(card.Index, 99)
+
+		a.Error(err, "no device error")
+
+		subdevices, err = ListSubdevices(card.Index, 0)
+		if err != nil {
+			// Not every card has a PCM device 0
+			continue
+		}
+		counts := make(map[bool]int)
+		for _, s := range subdevices {
+			counts[s.Playback]++
+		}
+		for _, s := range subdevices {
+			a.True(s.Available >= 0 && s.Available <= counts[s.Playback],
+				"available subdevices counted")
+		}
+	}
+}
+
+func TestCaptureLoop(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := NewCaptureDevice("null", 2, FormatS16LE, 44100, BufferParams{})
+
+	a.NoError(err, "created capture device")
+
+	blocks := 0
+	err = c.Capture(func(buf interface{}, frames int) error {
+		b, ok := buf.([]int16)
+		a.True(ok, "buffer matches format")
+		a.Equal(len(b), frames*2, "buffer holds all frames")
+		blocks++
+		if blocks == 3 {
+			return ErrStop
+		}
+		return nil
+	})
+
+	a.NoError(err, "capture stopped")
+	a.Equal(blocks, 3, "handler called until stopped")
+
+	c.Close()
+
+	a.NoError(c.Capture(func(buf interface{}, frames int) error {
+		return nil
+	}), "capture on closed device returns")
+
+	// Close stops Capture without the ThreadSafe option
+	c, err = NewCaptureDevice("null", 2, FormatS16LE, 44100, BufferParams{})
+
+	a.NoError(err, "created capture device")
+
+	started := make(chan struct{})
+	var once sync.Once
+	go func() {
+		<-started
+		c.Close()
+	}()
+
+	a.NoError(c.Capture(func(buf interface{}, frames int) error {
+		once.Do(func() { close(started) })
+		return nil
+	}), "capture stopped by close")
+}
+
+func TestStartWhenFull(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 44100,
+		BufferParams{BufferFrames: 4096, StartWhenFull: true})
+
+	a.NoError(err, "created playback device")
+	a.True(p.BufferParams.StartWhenFull, "start when full set")
+
+	threshold, err := p.startThreshold()
+
+	a.NoError(err, "got start threshold")
+	a.Equal(threshold, p.BufferParams.BufferFrames, "threshold is buffer size")
+
+	p.Close()
+}
+
+func TestListCards(t *testing.T) {
+	a := assert.New(t)
+
+	cards, err := ListCards()
+
+	a.NoError(err, "listed cards")
+	for _, card := range cards {
+		a.True(card.Index >= 0, "valid card index")
+	}
+
+	card, ok := controlCard("controlC3")
+
+	a.True(ok, "control node parsed")
+	a.Equal(card, 3, "card index parsed")
+
+	_, ok = controlCard("pcmC0D0p")
+
+	a.False(ok, "pcm node ignored")
+}
+
+func TestMonitor(t *testing.T) {
+	a := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "goalsa")
+	a.NoError(err, "created temporary directory")
+	defer os.RemoveAll(dir)
+
+	realDir := sndDevDir
+	defer func() { sndDevDir = realDir }()
+	sndDevDir = filepath.Join(dir, "snd")
+
+	m, err := NewMonitor()
+
+	a.NoError(err, "monitor created without device directory")
+
+	nextEvent := func() (ev CardEvent, ok bool) {
+		select {
+		case ev, ok = <-m.Events():
+		case <-time.After(5 * time.Second):
+		}
+		return
+	}
+
+	a.NoError(os.Mkdir(sndDevDir, 0755), "created device directory")
+	a.NoError(ioutil.WriteFile(filepath.Join(sndDevDir, "pcmC31D0p"), nil, 0644), "created pcm node")
+	a.NoError(ioutil.WriteFile(filepath.Join(sndDevDir, "controlC31"), nil, 0644), "created control node")
+
+	ev, ok := nextEvent()
+
+	a.True(ok, "card added event")
+	a.Equal(ev.Index, 31, "added card index")
+	a.False(ev.Removed, "card added")
+
+	a.NoError(os.Remove(filepath.Join(sndDevDir, "controlC31")), "removed control node")
+
+	ev, ok = nextEvent()
+
+	a.True(ok, "card removed event")
+	a.Equal(ev.Index, 31, "removed card index")
+	a.True(ev.Removed, "card removed")
+
+	a.NoError(m.Close(), "monitor closed")
+
+	_, ok = nextEvent()
+
+	a.False(ok, "events closed")
+}
+
+func TestPCMVolume(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 44100,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.GetPCMVolume()
+
+	a.Equal(err, ErrNoPCMVolume, "null device has no volume")
+	a.Equal(p.SetPCMVolume(0), ErrNoPCMVolume, "null device has no volume")
+
+	p.Close()
+
+	_, err = p.GetPCMVolume()
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+func TestErrorHandler(t *testing.T) {
+	a := assert.New(t)
+
+	var messages []string
+	SetErrorHandler(func(file string, line int, function string, err int, msg string) {
+		messages = append(messages, msg)
+	})
+
+	_, err := NewPlaybackDevice("nonexistent", 1, FormatS16LE, 44100,
+		BufferParams{})
+
+	a.Error(err, "no device error")
+	a.NotEmpty(messages, "error message handled")
+
+	SetErrorHandler(nil)
+}
+
+func TestPlaybackSimple(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDeviceSimple("nonexistent", FormatS16LE, 1, 44100,
+		false, 100000)
+
+	a.Equal(p, (*PlaybackDevice)(nil), "playback device is nil")
+	a.Error(err, "no device error")
+
+	p, err = NewPlaybackDeviceSimple("null", FormatS32LE, 2, 44100,
+		true, 100000)
+
+	a.NoError(err, "created playback device")
+	a.Equal(p.Channels, 2, "channels set")
+	a.True(p.BufferParams.BufferFrames > 0, "buffer size set")
+	a.True(p.BufferParams.PeriodFrames > 0, "period size set")
+
+	frames, err := p.Write(make([]int32, 200))
+
+	a.NoError(err, "buffer written ok")
+	a.Equal(frames, 200, "200 samples written")
+
+	p.Close()
+}
+
+func TestClientName(t *testing.T) {
+	a := assert.New(t)
+
+	os.Setenv("PULSE_PROP", "media.role=music")
+	os.Unsetenv("PIPEWIRE_PROPS")
+
+	clientNameMu.Lock()
+	restore := setClientName("goalsa test")
+
+	a.Equal(os.Getenv("PULSE_PROP"),
+		`application.name="goalsa test" media.name="goalsa test"`, "pulse name set")
+	a.Equal(os.Getenv("PIPEWIRE_PROPS"),
+		`{ application.name="goalsa test" media.name="goalsa test" }`, "pipewire name set")
+
+	restore()
+	clientNameMu.Unlock()
+
+	a.Equal(os.Getenv("PULSE_PROP"), "media.role=music", "pulse props restored")
+	_, ok := os.LookupEnv("PIPEWIRE_PROPS")
+	a.False(ok, "pipewire props restored")
+	os.Unsetenv("PULSE_PROP")
+
+	p, err := NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 44100,
+		BufferParams{}, DeviceOptions{ClientName: "goalsa test"})
+
+	a.NoError(err, "created playback device")
+
+	p.Close()
+}
+
+func TestWaitReady(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 44100,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	ready, err := p.WaitReady(time.Second)
+
+	a.NoError(err, "waited ok")
+	a.True(ready, "device is ready")
+
+	// snd_pcm_wait fails with EPIPE until the device is recovered
+	ops := defaultPCMOps
+	waits := 0
+	ops.wait = func(h pcmHandle, timeoutMs int) int {
+		waits++
+		return -int(syscall.EPIPE)
+	}
+	p.ops = &ops
+
+	ready, err = p.WaitReady(time.Second)
+
+	a.NoError(err, "recovered from xrun")
+	a.True(ready, "device is ready after recovery")
+	a.Equal(waits, 1, "wait not retried")
+	a.Equal(p.Underruns(), 1, "underrun counted")
+
+	state, err := p.State()
+
+	a.NoError(err, "got state")
+	a.Equal(state, State(StatePrepared), "device is prepared")
+
+	// A suspend is recovered from but is not an underrun
+	ops.wait = func(h pcmHandle, timeoutMs int) int {
+		return -int(syscall.ESTRPIPE)
+	}
+
+	ready, err = p.WaitReady(time.Second)
+
+	a.NoError(err, "recovered from suspend")
+	a.True(ready, "device is ready after resume")
+	a.Equal(p.Underruns(), 1, "suspend not counted")
+
+	p.Close()
+
+	_, err = p.WaitReady(time.Second)
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+func TestReadUntil(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := NewCaptureDevice("null", 1, FormatS16LE, 8000,
+		BufferParams{PeriodFrames: 800})
+
+	a.NoError(err, "created capture device")
+
+	buf, err := c.ReadUntil(func(level float64) bool {
+		return level < 0.01
+	}, time.Second)
+
+	a.NoError(err, "read until quiet")
+	a.Equal(len(buf), 800*2, "stopped after silent period")
+
+	buf, err = c.ReadUntil(func(level float64) bool {
+		return false
+	}, 250*time.Millisecond)
+
+	a.NoError(err, "read until max")
+	a.Equal(len(buf), 2000*2, "stopped at max duration")
+
+	c.Close()
+}
+
+func TestChunkFrames(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDeviceWithOptions("null", 2, FormatS16LE, 44100,
+		BufferParams{}, DeviceOptions{ChunkFrames: 64})
+
+	a.NoError(err, "created playback device")
+	a.Equal(p.chunkFrames, 64, "chunk size set")
+
+	samples, err := p.Write(make([]int16, 2*1000))
+
+	a.NoError(err, "buffer written ok")
+	a.Equal(samples, 2*1000, "all samples written in chunks")
+
+	p.Close()
+
+	p, err = NewPlaybackDevice("null", 2, FormatS16LE, 44100,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+	a.Equal(p.chunkFrames, p.BufferParams.BufferFrames, "chunk defaults to buffer")
+
+	p.Close()
+
+	p, err = NewPlaybackDeviceWithOptions("null", 2, FormatS16LE, 44100,
+		BufferParams{}, DeviceOptions{ChunkFrames: 64, ThreadSafe: true})
+
+	a.NoError(err, "created thread safe playback device")
+
+	done := make(chan struct{})
+	go func() {
+		samples, err := p.Write(make([]int16, 2*64*1000))
+		if err != nil {
+			a.Equal(err, ErrClosed, "write stopped by close")
+		}
+		a.Equal(samples%(2*64), 0, "whole chunks written")
+		close(done)
+	}()
+	p.Close()
+	<-done
+}
+
+func TestPowerOfTwoPeriod(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS16LE, 44100,
+		BufferParams{PeriodFrames: 1000, PowerOfTwoPeriod: true})
+
+	a.NoError(err, "created playback device")
+
+	period := p.BufferParams.PeriodFrames
+	a.True(period > 0 && period <= 1000, "period no larger than requested")
+	a.Equal(period&(period-1), 0, "period is a power of two")
+
+	p.Close()
+}
+
+func TestFallbackToNear(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 44100,
+		BufferParams{BufferFrames: 4096}, DeviceOptions{FallbackToNear: true})
+
+	a.NoError(err, "created playback device")
+	a.Len(p.Adjustments(), 0, "parameters granted exactly")
+
+	p.Close()
+
+	p, err = NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 0,
+		BufferParams{}, DeviceOptions{FallbackToNear: true})
+
+	a.NoError(err, "created playback device with nearest rate")
+	if a.Len(p.Adjustments(), 1, "rate adjusted") {
+		adjustment := p.Adjustments()[0]
+		a.Equal(adjustment.Param, "rate", "rate adjusted")
+		a.Equal(adjustment.Requested, 0, "requested rate reported")
+		a.Equal(adjustment.Granted, p.Rate, "granted rate reported")
+	}
+
+	p.Close()
+}
+
+func TestOpenTimeout(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 44100,
+		BufferParams{}, DeviceOptions{OpenTimeout: 5 * time.Second})
+
+	a.NoError(err, "opened within timeout")
+
+	p.Close()
+
+	p, err = NewPlaybackDeviceWithOptions("nonexistent", 1, FormatS32LE, 44100,
+		BufferParams{}, DeviceOptions{OpenTimeout: 5 * time.Second})
+
+	a.Equal(p, (*PlaybackDevice)(nil), "playback device is nil")
+	a.Error(err, "no device error")
+	a.NotEqual(err, ErrOpenTimeout, "open failed before timeout")
+
+	// An open which outlasts the timeout is closed once it completes, and
+	// does not hold up other opens while it hangs with clientNameMu held
+	ops := defaultPCMOps
+	opening := make(chan struct{})
+	release := make(chan struct{})
+	closed := make(chan struct{})
+	ops.open = func(deviceName string, stream pcmStream, mode int) (pcmHandle, int) {
+		close(opening)
+		<-release
+		return defaultPCMOps.open(deviceName, stream, mode)
+	}
+	ops.close = func(h pcmHandle) int {
+		defer close(closed)
+		return defaultPCMOps.close(h)
+	}
+	p = &PlaybackDevice{}
+	p.ops = &ops
+	err = p.createDevice("null", 1, FormatS32LE, 44100, true,
+		BufferParams{}, DeviceOptions{OpenTimeout: 10 * time.Millisecond,
+			ClientName: "hung"})
+
+	a.Equal(err, ErrOpenTimeout, "open timed out")
+
+	<-opening
+	p, err = NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 44100,
+		BufferParams{}, DeviceOptions{OpenTimeout: time.Second})
+
+	a.NoError(err, "opened while another open hangs")
+
+	p.Close()
+
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		a.Fail("late open not closed")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	a := assert.New(t)
+
+	a.NotEmpty(Version(), "version reported")
+}
+
+func TestEstimatedLatency(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 8000,
+		BufferParams{BufferFrames: 4000}, DeviceOptions{LatencyWarning: time.Millisecond})
+
+	a.NoError(err, "created playback device")
+	a.Equal(p.EstimatedLatency(),
+		time.Duration(p.BufferParams.BufferFrames)*time.Second/8000, "latency from buffer")
+
+	p.Close()
+}
+
+func TestDuplex(t *testing.T) {
+	a := assert.New(t)
+
+	d, err := NewDuplexDevice("nonexistent", 1, FormatS16LE, 44100,
+		BufferParams{}, BufferParams{})
+
+	a.Equal(d, (*DuplexDevice)(nil), "duplex device is nil")
+	a.Error(err, "no device error")
+
+	d, err = NewDuplexDevice("null", 1, FormatS16LE, 44100,
+		BufferParams{BufferFrames: 512, PeriodFrames: 128},
+		BufferParams{BufferFrames: 8192, PeriodFrames: 2048})
+
+	a.NoError(err, "created duplex device")
+	a.Equal(d.Capture.BufferParams.PeriodFrames, 128, "capture period set")
+	a.Equal(d.Playback.BufferParams.PeriodFrames, 2048, "playback period set")
+	a.Equal(d.Capture.PeriodBytes(), 128*2, "capture period bytes")
+	a.Equal(d.Playback.PeriodBytes(), 2048*2, "playback period bytes")
+
+	d.Close()
+}
+
+func TestClosePolicy(t *testing.T) {
+	a := assert.New(t)
+
+	for _, policy := range []ClosePolicy{ClosePolicyAuto, ClosePolicyDrain, ClosePolicyDrop} {
+		p, err := NewPlaybackDeviceWithOptions("null", 1, FormatS32LE, 44100,
+			BufferParams{}, DeviceOptions{ClosePolicy: policy})
+
+		a.NoError(err, "created playback device")
+
+		_, err = p.Write(make([]int32, 100))
+
+		a.NoError(err, "buffer written ok")
+
+		p.Close()
+
+		_, err = p.State()
+
+		a.Equal(err, ErrClosed, "device is closed")
+	}
+}
+
+func TestRecommendPeriods(t *testing.T) {
+	a := assert.New(t)
+
+	_, err := RecommendPeriods("nonexistent", 1, FormatS16LE, 44100,
+		100*time.Millisecond)
+
+	a.Error(err, "no device error")
+
+	_, err = RecommendPeriods("null", 1, FormatS16LE, 44100, 0)
+
+	a.Error(err, "no latency error")
+
+	periods, err := RecommendPeriods("null", 2, FormatS16LE, 44100,
+		100*time.Millisecond)
+
+	a.NoError(err, "periods recommended")
+	a.True(periods >= 2 && periods <= recommendedPeriods, "sensible period count")
+}
+
+func TestRingBuffer(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := NewCaptureDevice("null", 1, FormatS32LE, 44100, BufferParams{})
+
+	a.NoError(err, "created capture device")
+	a.Error(c.StartRingBuffer(0), "ring too small error")
+	a.NoError(c.StartRingBuffer(44100), "ring buffer started")
+	a.Error(c.StartRingBuffer(44100), "ring buffer already running")
+	a.Error(c.StartReadThread(), "ring buffer already running")
+
+	b := make([]int32, 1000)
+	samples, err := c.Read(b)
+
+	a.NoError(err, "read samples ok")
+	a.Equal(samples, len(b), "correct number of samples read")
+
+	frames, capacity := c.RingBufferLevel()
+
+	a.True(frames <= capacity, "level within capacity")
+	a.True(capacity <= 44100, "capacity within maximum")
+
+	c.Close()
+
+	frames, capacity = c.RingBufferLevel()
+
+	a.Equal(frames, 0, "no frames buffered")
+	a.Equal(capacity, 0, "no ring buffer")
+	a.Equal(c.StartRingBuffer(44100), ErrClosed, "device is closed")
+}
+
+func TestExportBuffer(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS16LE, 44100,
+		BufferParams{ExportBuffer: true})
+
+	a.NoError(err, "created playback device")
+	a.True(p.BufferParams.ExportBuffer, "export buffer set")
+
+	p.Close()
+}
+
+func TestMeasuredLatency(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 8000,
+		BufferParams{BufferFrames: 4000})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.MeasuredLatency()
+
+	a.Error(err, "not running error")
+
+	_, err = p.Write(make([]int32, p.BufferParams.BufferFrames))
+
+	a.NoError(err, "buffer written ok")
+	a.NoError(p.WaitRunning(time.Second), "device running")
+
+	latency, err := p.MeasuredLatency()
+
+	a.NoError(err, "latency measured")
+	a.True(latency <= p.EstimatedLatency(), "latency within buffer")
+
+	p.Close()
+
+	_, err = p.MeasuredLatency()
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+func TestChannelsAuto(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := NewCaptureDeviceWithOptions("null", 0, FormatS16LE, 44100,
+		BufferParams{BufferFrames: 256}, DeviceOptions{ChannelsAuto: true})
+
+	a.NoError(err, "created capture device")
+	a.True(c.Channels > 0, "channels chosen")
+
+	c.Close()
+}
+
+func TestPassthrough(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := NewCaptureDevice("null", 2, FormatS16LE, 44100, BufferParams{})
+
+	a.NoError(err, "created capture device")
+
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 44100, BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	b := make([]byte, 100*4+1)
+	frames, err := c.ReadPassthrough(b)
+
+	a.NoError(err, "read frames ok")
+	a.Equal(frames, 100, "whole frames read")
+
+	frames, err = p.WritePassthrough(b[:frames*4])
+
+	a.NoError(err, "wrote frames ok")
+	a.Equal(frames, 100, "all frames written")
+
+	c.Close()
+	p.Close()
+
+	_, err = p.WritePassthrough(b)
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+func TestFallbackChannels(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := NewCaptureDeviceWithOptions("null", 0, FormatS16LE, 44100,
+		BufferParams{}, DeviceOptions{FallbackChannels: true})
+
+	a.NoError(err, "created capture device with nearest channels")
+	if a.Len(c.Adjustments(), 1, "channels adjusted") {
+		adjustment := c.Adjustments()[0]
+		a.Equal(adjustment.Param, "channels", "channels adjusted")
+		a.Equal(adjustment.Granted, c.Channels, "granted channels reported")
+	}
+
+	c.Close()
+}
+
+func TestConfigReport(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 44100,
+		BufferParams{BufferFrames: 4096, Periods: 4})
+
+	a.NoError(err, "created playback device")
+
+	report := p.ConfigReport()
+
+	a.Equal(report.Requested.Access, "RW_INTERLEAVED", "access requested")
+	a.Equal(report.Requested.BufferFrames, 4096, "buffer requested")
+	a.Equal(report.Requested.PeriodFrames, 0, "default period requested")
+	a.Equal(report.Granted.Format, p.Format, "format granted")
+	a.Equal(report.Granted.Channels, 2, "channels granted")
+	a.Equal(report.Granted.BufferFrames, p.BufferParams.BufferFrames, "buffer granted")
+	a.Equal(report.Granted.Periods, p.BufferParams.Periods, "periods granted")
+
+	p.Close()
+}
+
+func TestSeekReset(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 8000,
+		BufferParams{BufferFrames: 4000})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.Write(make([]int32, 1000))
+
+	a.NoError(err, "buffer written ok")
+	a.Error(p.SeekReset(-time.Second), "negative preroll error")
+	a.NoError(p.SeekReset(100*time.Millisecond), "seek reset ok")
+	a.NoError(p.SeekReset(time.Minute), "preroll limited to buffer")
+
+	p.Close()
+
+	a.Equal(p.SeekReset(0), ErrClosed, "device is closed")
+}
+
+func TestRealtimePlayer(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS16LE, 8000,
+		BufferParams{BufferFrames: 800, PeriodFrames: 200})
+
+	a.NoError(err, "created playback device")
+
+	_, err = NewRealtimePlayer(p, RealtimeOptions{RingFrames: 100})
+
+	a.Error(err, "ring too small error")
+
+	r, err := NewRealtimePlayer(p, RealtimeOptions{RingFrames: 1000})
+
+	a.NoError(err, "created realtime player")
+
+	time.Sleep(100 * time.Millisecond)
+
+	a.Equal(r.SilenceFrames(), 0, "no silence before playback starts")
+
+	_, err = r.Push(make([]int32, 100))
+
+	a.Error(err, "wrong type error")
+
+	samples, err := r.Push(make([]int16, 2000))
+
+	a.NoError(err, "pushed samples ok")
+	a.True(samples > 0 && samples <= 1000, "push limited to ring")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Buffered() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	a.Equal(r.Buffered(), 0, "ring drained to device")
+	a.True(r.Latency() >= 0, "latency reported")
+	a.NoError(r.Err(), "no writer error")
+
+	r.Close()
+
+	_, err = p.State()
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+func TestWriteAll(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 3, FormatS24LE, 8000,
+		BufferParams{BufferFrames: 800})
+
+	a.NoError(err, "created playback device")
+	a.Error(p.WriteAll(make([]int16, 300)), "wrong type error")
+	a.NoError(p.WriteAll(make([]int32, 3*4000)), "buffer larger than device written")
+	a.NoError(p.WriteAll(make([]int32, 0)), "empty buffer written")
+
+	p.Close()
+
+	a.Equal(p.WriteAll(make([]int32, 3)), ErrClosed, "device is closed")
+
+	p, err = NewPlaybackDevice("null", 1, FormatS32LE, 8000,
+		BufferParams{BufferFrames: 800})
+
+	a.NoError(err, "created playback device")
+
+	ops := defaultPCMOps
+	waits := 0
+	ops.wait = func(h pcmHandle, timeoutMs int) int {
+		waits++
+		return 1
+	}
+	p.ops = &ops
+
+	// Short writes wait for room and carry on from where they stopped
+	written := 0
+	ops.writei = func(h pcmHandle, buf unsafe.Pointer, frames int) int {
+		if frames > 30 {
+			frames = 30
+		}
+		ret := defaultPCMOps.writei(h, buf, frames)
+		if ret > 0 {
+			written += ret
+		}
+		return ret
+	}
+
+	a.NoError(p.WriteAll(make([]int32, 100)), "short writes completed")
+	a.Equal(written, 100, "all frames written")
+	a.Equal(waits, 3, "waited after each short write")
+
+	// An underrun is recovered from and the write retried
+	underruns := 1
+	ops.writei = func(h pcmHandle, buf unsafe.Pointer, frames int) int {
+		if underruns > 0 {
+			underruns--
+			return -int(syscall.EPIPE)
+		}
+		return defaultPCMOps.writei(h, buf, frames)
+	}
+
+	a.NoError(p.WriteAll(make([]int32, 100)), "written after underrun")
+	a.Equal(p.Underruns(), 1, "underrun counted")
+
+	// A device which underruns again without accepting any frames fails
+	writes := 0
+	ops.writei = func(h pcmHandle, buf unsafe.Pointer, frames int) int {
+		writes++
+		return -int(syscall.EPIPE)
+	}
+
+	a.Equal(p.WriteAll(make([]int32, 100)), ErrUnderrun, "repeated underrun error")
+	a.Equal(writes, 2, "write retried once")
+
+	p.Close()
+}
+
+func TestPlaybackControl(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS16LE, 8000,
+		BufferParams{BufferFrames: 800})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.Write(make([]int16, 800))
+
+	a.NoError(err, "buffer written ok")
+
+	err = p.Pause(true)
+	if err != ErrPauseUnsupported {
+		a.NoError(err, "paused ok")
+		a.NoError(p.Pause(false), "resumed ok")
+	}
+
+	a.NoError(p.Drop(), "dropped ok")
+	a.NoError(p.Prepare(), "prepared after drop")
+
+	_, err = p.Write(make([]int16, 800))
+
+	a.NoError(err, "buffer written after drop")
+	a.NoError(p.Drain(), "drained ok")
+	a.NoError(p.Prepare(), "prepared after drain")
+
+	p.Close()
+
+	a.Equal(p.Drain(), ErrClosed, "drain on closed device")
+	a.Equal(p.Drop(), ErrClosed, "drop on closed device")
+	a.Equal(p.Pause(true), ErrClosed, "pause on closed device")
+}
+
+func TestReaderWriter(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := NewCaptureDevice("null", 2, FormatS16LE, 44100, BufferParams{})
+
+	a.NoError(err, "created capture device")
+
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 44100, BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	_, err = c.ReadBytes(make([]byte, 5))
+
+	a.Error(err, "partial frame read error")
+
+	_, err = p.WriteBytes(make([]byte, 5))
+
+	a.Error(err, "partial frame write error")
+
+	n, err := io.CopyBuffer(p.Writer(), io.LimitReader(c.Reader(), 4000),
+		make([]byte, 400))
+
+	a.NoError(err, "copied capture to playback")
+	a.Equal(n, int64(4000), "all bytes copied")
+
+	c.Close()
+	p.Close()
+
+	_, err = p.Writer().Write(make([]byte, 4))
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+func TestQueryCapabilities(t *testing.T) {
+	a := assert.New(t)
+
+	caps, err := QueryCapabilities("nonexistent", true)
+
+	a.Equal(caps, (*Capabilities)(nil), "capabilities are nil")
+	a.Error(err, "no device error")
+
+	caps, err = QueryCapabilities("null", false)
+
+	a.NoError(err, "queried capabilities")
+	a.Contains(caps.Formats, Format(FormatS16LE), "16-bit format supported")
+	a.True(caps.MinRate <= 44100 && caps.MaxRate >= 44100, "rate range")
+	a.True(caps.MinChannels >= 1 && caps.MaxChannels >= caps.MinChannels, "channel range")
+}
+
+func TestCloseNow(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 8000,
+		BufferParams{BufferFrames: 4000})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.Write(make([]int32, 4000))
+
+	a.NoError(err, "buffer written ok")
+
+	p.CloseNow()
+
+	_, err = p.State()
+
+	a.Equal(err, ErrClosed, "device is closed")
+
+	p.CloseNow()
+
+	_, err = p.Write(make([]int32, 100))
+
+	a.Equal(err, ErrClosed, "write to closed device")
+}
+
+func TestReset(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 8000,
+		BufferParams{BufferFrames: 4000})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.Write(make([]int32, 2000))
+
+	a.NoError(err, "buffer written ok")
+	a.NoError(p.WaitRunning(time.Second), "device running")
+	a.NoError(p.Reset(), "device reset")
+
+	latency, err := p.MeasuredLatency()
+
+	a.NoError(err, "device still running")
+	a.Equal(latency, time.Duration(0), "no delay after reset")
+
+	_, err = p.Write(make([]int32, 100))
+
+	a.NoError(err, "device usable after reset")
+
+	p.Close()
+
+	a.Equal(p.Reset(), ErrClosed, "device is closed")
+}
+
+func TestPrepareError(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 1, FormatS32LE, 8000,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+	a.NoError(p.Drop(), "dropped ok")
+
+	_, err = p.Write(make([]int32, 100))
+
+	if a.Error(err, "write to stopped device") {
+		a.Contains(err.Error(), "Prepare", "error suggests Prepare")
+	}
 
 	p.Close()
 }
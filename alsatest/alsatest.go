@@ -0,0 +1,28 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+// Package alsatest provides test helpers for code using the alsa package.
+package alsatest
+
+// TestingT is the subset of testing.T used by the helpers.
+type TestingT interface {
+	Errorf(format string, args ...interface{})
+}
+
+// XrunCounter is implemented by alsa.CaptureDevice and alsa.PlaybackDevice.
+type XrunCounter interface {
+	Underruns() int
+	Overruns() int
+}
+
+// AssertNoXruns fails the test if the device has had any underruns or
+// overruns, returning whether it passed.
+func AssertNoXruns(t TestingT, d XrunCounter) bool {
+	underruns, overruns := d.Underruns(), d.Overruns()
+	if underruns != 0 || overruns != 0 {
+		t.Errorf("device had %d underruns and %d overruns", underruns, overruns)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsatest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cocoonlife/testify/assert"
+)
+
+type counter struct {
+	underruns, overruns int
+}
+
+func (c counter) Underruns() int { return c.underruns }
+func (c counter) Overruns() int  { return c.overruns }
+
+type recorder struct {
+	errors []string
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertNoXruns(t *testing.T) {
+	a := assert.New(t)
+
+	r := new(recorder)
+
+	a.True(AssertNoXruns(r, counter{}), "no xruns passes")
+	a.Len(r.errors, 0, "no failure reported")
+
+	a.False(AssertNoXruns(r, counter{underruns: 2}), "underruns fail")
+	a.False(AssertNoXruns(r, counter{overruns: 1}), "overruns fail")
+	a.Equal(r.errors, []string{
+		"device had 2 underruns and 0 overruns",
+		"device had 0 underruns and 1 overruns",
+	}, "failures reported")
+}
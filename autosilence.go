@@ -0,0 +1,127 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+)
+
+/*
+#include <alsa/asoundlib.h>
+*/
+import "C"
+
+// EnableAutoSilence starts a background worker which writes a period of
+// silence to the device whenever less than one period of audio remains
+// queued, so that a late producer results in silence rather than an
+// underrun. If the device has already underrun the worker prepares it and
+// restarts it with silence.
+func (p *PlaybackDevice) EnableAutoSilence() error {
+	if p.h == nil {
+		return ErrClosed
+	}
+	p.silenceMu.Lock()
+	defer p.silenceMu.Unlock()
+	if p.silenceStop != nil {
+		return errors.New("auto silence already enabled")
+	}
+	p.silenceStop = make(chan struct{})
+	p.silenceDone = make(chan struct{})
+	go p.autoSilenceLoop(p.silenceStop, p.silenceDone)
+	return nil
+}
+
+// DisableAutoSilence stops the auto silence worker, if it is running.
+func (p *PlaybackDevice) DisableAutoSilence() {
+	// The worker takes silenceMu too, so wait for it without the lock
+	p.silenceMu.Lock()
+	stop, done := p.silenceStop, p.silenceDone
+	p.silenceStop, p.silenceDone = nil, nil
+	p.silenceMu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// SilenceFrames returns the number of frames of silence inserted by the
+// auto silence worker.
+func (p *PlaybackDevice) SilenceFrames() int {
+	p.silenceMu.Lock()
+	defer p.silenceMu.Unlock()
+	return p.silenceFrames
+}
+
+// Close stops the auto silence worker, then closes the device and frees
+// the resources associated with it.
+func (p *PlaybackDevice) Close() {
+	p.DisableAutoSilence()
+	p.device.Close()
+}
+
+// CloseNow stops the auto silence worker, then closes the device without
+// waiting for pending audio to play.
+func (p *PlaybackDevice) CloseNow() {
+	p.DisableAutoSilence()
+	p.device.CloseNow()
+}
+
+func (p *PlaybackDevice) autoSilenceLoop(stop, done chan struct{}) {
+	defer close(done)
+
+	frames := p.BufferParams.PeriodFrames
+	silence := make([]byte, frames*p.Channels*p.formatSampleSize())
+	silencePtr := unsafe.Pointer(&silence[0])
+	C.snd_pcm_format_set_silence(C.snd_pcm_format_t(p.Format), silencePtr, C.uint(frames*p.Channels))
+
+	// Check twice per period so there is always time to react
+	interval := time.Duration(frames) * time.Second / time.Duration(p.Rate) / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		p.writeMu.Lock()
+		written := p.insertSilence(silencePtr, frames)
+		p.writeMu.Unlock()
+		if written > 0 {
+			p.silenceMu.Lock()
+			p.silenceFrames += written
+			p.silenceMu.Unlock()
+		}
+	}
+}
+
+// insertSilence writes a period of silence if the device is about to run
+// dry and returns the number of frames written. It must be called with
+// writeMu held.
+func (p *PlaybackDevice) insertSilence(silence unsafe.Pointer, frames int) int {
+	switch C.snd_pcm_state(p.h) {
+	case C.SND_PCM_STATE_XRUN:
+		p.countXrun()
+		if C.snd_pcm_prepare(p.h) < 0 {
+			return 0
+		}
+	case C.SND_PCM_STATE_RUNNING:
+		avail := C.snd_pcm_avail(p.h)
+		if avail < 0 || int(avail) < p.BufferParams.BufferFrames-frames {
+			return 0
+		}
+	default:
+		return 0
+	}
+	ret := C.snd_pcm_writei(p.h, silence, C.snd_pcm_uframes_t(frames))
+	if ret < 0 {
+		return 0
+	}
+	return int(ret)
+}
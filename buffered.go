@@ -0,0 +1,88 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"unsafe"
+)
+
+// BufferedWriter coalesces small writes to a PlaybackDevice into larger
+// ones, saving the fixed cost of a call into ALSA for each small buffer.
+// Buffered audio is only played once a full buffer has been collected or
+// Flush is called.
+type BufferedWriter struct {
+	p          *PlaybackDevice
+	buf        []byte
+	frameBytes int
+}
+
+// NewBufferedWriter creates a BufferedWriter which writes to p in blocks of
+// the given number of frames. If frames is zero the period size is used.
+func NewBufferedWriter(p *PlaybackDevice, frames int) *BufferedWriter {
+	if frames <= 0 {
+		frames = p.BufferParams.PeriodFrames
+	}
+	frameBytes := p.Channels * p.formatSampleSize()
+	return &BufferedWriter{
+		p:          p,
+		buf:        make([]byte, 0, frames*frameBytes),
+		frameBytes: frameBytes,
+	}
+}
+
+// Write buffers samples, writing to the device each time the buffer fills,
+// and returns the number of samples accepted. Buffers use the same sample
+// types as PlaybackDevice.Write.
+func (b *BufferedWriter) Write(buffer interface{}) (samples int, err error) {
+	sampleSize := b.p.formatSampleSize()
+	in, err := bufferBytes(buffer, sampleSize)
+	if err != nil {
+		return 0, err
+	}
+	accepted := 0
+	for len(in) > 0 {
+		n := copy(b.buf[len(b.buf):cap(b.buf)], in)
+		b.buf = b.buf[:len(b.buf)+n]
+		in = in[n:]
+		accepted += n
+		if len(b.buf) == cap(b.buf) {
+			if err = b.flush(); err != nil {
+				return accepted / sampleSize, err
+			}
+		}
+	}
+	return accepted / sampleSize, nil
+}
+
+// Flush writes any whole frames held in the buffer to the device.
+func (b *BufferedWriter) Flush() error {
+	return b.flush()
+}
+
+func (b *BufferedWriter) flush() error {
+	frames := len(b.buf) / b.frameBytes
+	if frames == 0 {
+		return nil
+	}
+	b.p.lock()
+	defer b.p.unlock()
+	if b.p.h == nil {
+		return ErrClosed
+	}
+	written := 0
+	for written < frames {
+		n, err := b.p.writeFrames(unsafe.Pointer(&b.buf[written*b.frameBytes]), frames-written)
+		// Frames written before an error have been played and must not
+		// be kept for the next flush
+		written += n
+		if err != nil {
+			b.buf = b.buf[:copy(b.buf, b.buf[written*b.frameBytes:])]
+			return err
+		}
+	}
+	// Keep any partial frame for the next write
+	b.buf = b.buf[:copy(b.buf, b.buf[frames*b.frameBytes:])]
+	return nil
+}
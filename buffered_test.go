@@ -0,0 +1,85 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"testing"
+
+	"github.com/cocoonlife/testify/assert"
+)
+
+func TestBufferedWriter(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 48000,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	b := NewBufferedWriter(p, 1024)
+
+	_, err = b.Write(make([]int32, 256))
+
+	a.Error(err, "wrong type error")
+
+	for i := 0; i < 20; i++ {
+		samples, err := b.Write(make([]int16, 256))
+		a.NoError(err, "buffer written ok")
+		a.Equal(samples, 256, "all samples accepted")
+	}
+
+	samples, err := b.Write(make([]int16, 1))
+
+	a.NoError(err, "partial frame accepted")
+	a.Equal(samples, 1, "partial frame buffered")
+	a.NoError(b.Flush(), "buffer flushed")
+	a.Equal(len(b.buf), 2, "partial frame kept")
+
+	p.Close()
+
+	_, err = b.Write(make([]int16, 4096))
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
+
+// The benchmarks write 128 frame buffers, as used by low latency audio
+// graphs, to compare the cost of a call into ALSA per buffer with
+// coalescing the buffers into periods.
+
+func BenchmarkWrite128(b *testing.B) {
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 48000,
+		BufferParams{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+	buf := make([]int16, 128*2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBufferedWrite128(b *testing.B) {
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 48000,
+		BufferParams{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer p.Close()
+	w := NewBufferedWriter(p, 0)
+	buf := make([]int16, 128*2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := w.Write(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
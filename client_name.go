@@ -0,0 +1,48 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// The PipeWire and PulseAudio ALSA plugins take the properties of the
+// streams they create from the environment when the PCM is opened.
+var clientNameEnv = map[string]string{
+	"PIPEWIRE_PROPS": "{ application.name=%[1]q media.name=%[1]q }",
+	"PULSE_PROP":     "application.name=%[1]q media.name=%[1]q",
+}
+
+// clientNameMu is held around every labelled PCM open, so that two opens
+// never set the environment at once. Unlabelled opens do not take it, so
+// that one which hangs cannot hold up the rest.
+var clientNameMu sync.Mutex
+
+// setClientName sets the environment so that a PCM opened through PipeWire
+// or PulseAudio is labelled with name. It returns a function which restores
+// the environment once the PCM is open. It must be called with clientNameMu
+// held, and the lock kept until the environment is restored.
+func setClientName(name string) (restore func()) {
+	saved := make(map[string]*string)
+	for key, format := range clientNameEnv {
+		if value, ok := os.LookupEnv(key); ok {
+			saved[key] = &value
+		} else {
+			saved[key] = nil
+		}
+		os.Setenv(key, fmt.Sprintf(format, name))
+	}
+	return func() {
+		for key, value := range saved {
+			if value != nil {
+				os.Setenv(key, *value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+}
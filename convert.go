@@ -0,0 +1,273 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"unsafe"
+)
+
+// sampleEncoder returns a function which stores a sample in the range
+// [-1, 1] into b using the given format. Values outside the range are
+// clipped.
+func sampleEncoder(format Format) func(b []byte, v float64) {
+	switch format {
+	case FormatS8:
+		return func(b []byte, v float64) { b[0] = byte(int8(scaleSample(v, 1<<7-1))) }
+	case FormatU8:
+		return func(b []byte, v float64) { b[0] = byte(scaleSample(v, 1<<7-1) + 1<<7) }
+	case FormatS16LE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint16(b, uint16(scaleSample(v, 1<<15-1))) }
+	case FormatS16BE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint16(b, uint16(scaleSample(v, 1<<15-1))) }
+	case FormatU16LE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint16(b, uint16(scaleSample(v, 1<<15-1)+1<<15)) }
+	case FormatU16BE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint16(b, uint16(scaleSample(v, 1<<15-1)+1<<15)) }
+	case FormatS24LE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint32(b, uint32(scaleSample(v, 1<<23-1))) }
+	case FormatS24BE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint32(b, uint32(scaleSample(v, 1<<23-1))) }
+	case FormatU24LE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint32(b, uint32(scaleSample(v, 1<<23-1)+1<<23)) }
+	case FormatU24BE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint32(b, uint32(scaleSample(v, 1<<23-1)+1<<23)) }
+	case FormatS32LE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint32(b, uint32(scaleSample(v, 1<<31-1))) }
+	case FormatS32BE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint32(b, uint32(scaleSample(v, 1<<31-1))) }
+	case FormatU32LE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint32(b, uint32(scaleSample(v, 1<<31-1)+1<<31)) }
+	case FormatU32BE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint32(b, uint32(scaleSample(v, 1<<31-1)+1<<31)) }
+	case FormatFloatLE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint32(b, math.Float32bits(float32(v))) }
+	case FormatFloatBE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint32(b, math.Float32bits(float32(v))) }
+	case FormatFloat64LE:
+		return func(b []byte, v float64) { binary.LittleEndian.PutUint64(b, math.Float64bits(v)) }
+	case FormatFloat64BE:
+		return func(b []byte, v float64) { binary.BigEndian.PutUint64(b, math.Float64bits(v)) }
+	}
+	panic("unsupported format")
+}
+
+// sampleDecoder returns a function which reads a sample stored in b using
+// the given format and returns it scaled to the range [-1, 1]. It is the
+// inverse of sampleEncoder.
+func sampleDecoder(format Format) func(b []byte) float64 {
+	switch format {
+	case FormatS8:
+		return func(b []byte) float64 { return float64(int8(b[0])) / (1<<7 - 1) }
+	case FormatU8:
+		return func(b []byte) float64 { return float64(int(b[0])-1<<7) / (1<<7 - 1) }
+	case FormatS16LE:
+		return func(b []byte) float64 { return float64(int16(binary.LittleEndian.Uint16(b))) / (1<<15 - 1) }
+	case FormatS16BE:
+		return func(b []byte) float64 { return float64(int16(binary.BigEndian.Uint16(b))) / (1<<15 - 1) }
+	case FormatU16LE:
+		return func(b []byte) float64 { return float64(int(binary.LittleEndian.Uint16(b))-1<<15) / (1<<15 - 1) }
+	case FormatU16BE:
+		return func(b []byte) float64 { return float64(int(binary.BigEndian.Uint16(b))-1<<15) / (1<<15 - 1) }
+	case FormatS24LE:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b)<<8)>>8) / (1<<23 - 1) }
+	case FormatS24BE:
+		return func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b)<<8)>>8) / (1<<23 - 1) }
+	case FormatU24LE:
+		return func(b []byte) float64 {
+			return float64(int(binary.LittleEndian.Uint32(b)&0xffffff)-1<<23) / (1<<23 - 1)
+		}
+	case FormatU24BE:
+		return func(b []byte) float64 { return float64(int(binary.BigEndian.Uint32(b)&0xffffff)-1<<23) / (1<<23 - 1) }
+	case FormatS32LE:
+		return func(b []byte) float64 { return float64(int32(binary.LittleEndian.Uint32(b))) / (1<<31 - 1) }
+	case FormatS32BE:
+		return func(b []byte) float64 { return float64(int32(binary.BigEndian.Uint32(b))) / (1<<31 - 1) }
+	case FormatU32LE:
+		return func(b []byte) float64 { return float64(int64(binary.LittleEndian.Uint32(b))-1<<31) / (1<<31 - 1) }
+	case FormatU32BE:
+		return func(b []byte) float64 { return float64(int64(binary.BigEndian.Uint32(b))-1<<31) / (1<<31 - 1) }
+	case FormatFloatLE:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))) }
+	case FormatFloatBE:
+		return func(b []byte) float64 { return float64(math.Float32frombits(binary.BigEndian.Uint32(b))) }
+	case FormatFloat64LE:
+		return func(b []byte) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(b)) }
+	case FormatFloat64BE:
+		return func(b []byte) float64 { return math.Float64frombits(binary.BigEndian.Uint64(b)) }
+	}
+	panic("unsupported format")
+}
+
+// sampleSize returns the size in bytes of a sample in the given format.
+func sampleSize(format Format) int {
+	return device{Format: format}.formatSampleSize()
+}
+
+// bufferBytes returns the memory of a slice of samples as bytes, checking
+// that its element type matches the given sample size.
+func bufferBytes(buffer interface{}, sampleSize int) ([]byte, error) {
+	val := reflect.ValueOf(buffer)
+	if val.Kind() != reflect.Slice {
+		return nil, errors.New("buffer must be a slice")
+	}
+	switch val.Type().Elem().Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Float32, reflect.Float64:
+	default:
+		return nil, errors.New("buffer type does not support this format")
+	}
+	if int(val.Type().Elem().Size()) != sampleSize {
+		return nil, errors.New("buffer requires a matching sample size")
+	}
+	length := val.Len() * sampleSize
+	if length == 0 {
+		return nil, nil
+	}
+	ptr := unsafe.Pointer(val.Index(0).Addr().Pointer())
+	return (*[1 << 30]byte)(ptr)[:length:length], nil
+}
+
+// scaleSample clips v to [-1, 1] and scales it to a signed integer with the
+// given full scale value.
+func scaleSample(v float64, max int64) int64 {
+	if v > 1 {
+		v = 1
+	} else if v < -1 {
+		v = -1
+	}
+	return int64(math.Floor(v*float64(max) + 0.5))
+}
+
+// scratchBuffer returns a scratch buffer of at least the given size which
+// is reused between calls.
+func (p *PlaybackDevice) scratchBuffer(size int) []byte {
+	if cap(p.scratch) < size {
+		p.scratch = make([]byte, size)
+	}
+	return p.scratch[:size]
+}
+
+// WritePlanarFloat32 interleaves per-channel buffers of samples in the range
+// [-1, 1], converts them to the device format and writes them to the device.
+// There must be one buffer per channel and all buffers must be the same
+// length.
+func (p *PlaybackDevice) WritePlanarFloat32(channels [][]float32) (samples int, err error) {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return 0, ErrClosed
+	}
+	if len(channels) != p.Channels {
+		return 0, errors.New("WritePlanarFloat32 requires one buffer per channel")
+	}
+	frames := len(channels[0])
+	for _, ch := range channels {
+		if len(ch) != frames {
+			return 0, errors.New("WritePlanarFloat32 requires buffers of equal length")
+		}
+	}
+	if frames == 0 {
+		return 0, nil
+	}
+
+	encode := sampleEncoder(p.Format)
+	sampleSize := p.formatSampleSize()
+	buf := p.scratchBuffer(frames * p.Channels * sampleSize)
+	offset := 0
+	for i := 0; i < frames; i++ {
+		for _, ch := range channels {
+			encode(buf[offset:], float64(ch[i]))
+			offset += sampleSize
+		}
+	}
+
+	frames, err = p.writeFrames(unsafe.Pointer(&buf[0]), frames)
+	return frames * p.Channels, err
+}
+
+// WritePlanar interleaves per-channel buffers of samples and writes them to
+// the device. channels must be a [][]int8, [][]int16 or [][]int32 with one
+// buffer per channel, all of the same length, and an element size matching
+// the device format.
+func (p *PlaybackDevice) WritePlanar(channels interface{}) (samples int, err error) {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return 0, ErrClosed
+	}
+	val := reflect.ValueOf(channels)
+	if val.Kind() != reflect.Slice || val.Type().Elem().Kind() != reflect.Slice {
+		return 0, errors.New("WritePlanar requires a slice of channel buffers")
+	}
+	switch val.Type().Elem().Elem().Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+	default:
+		return 0, errors.New("WritePlanar requires integer samples")
+	}
+	if val.Len() != p.Channels {
+		return 0, errors.New("WritePlanar requires one buffer per channel")
+	}
+	sampleSize := p.formatSampleSize()
+	planes := make([][]byte, p.Channels)
+	for i := range planes {
+		planes[i], err = bufferBytes(val.Index(i).Interface(), sampleSize)
+		if err != nil {
+			return 0, err
+		}
+		if len(planes[i]) != len(planes[0]) {
+			return 0, errors.New("WritePlanar requires buffers of equal length")
+		}
+	}
+	frames := len(planes[0]) / sampleSize
+	if frames == 0 {
+		return 0, nil
+	}
+
+	buf := p.scratchBuffer(frames * p.Channels * sampleSize)
+	offset := 0
+	for i := 0; i < frames; i++ {
+		for _, plane := range planes {
+			copy(buf[offset:offset+sampleSize], plane[i*sampleSize:])
+			offset += sampleSize
+		}
+	}
+
+	frames, err = p.writeFrames(unsafe.Pointer(&buf[0]), frames)
+	return frames * p.Channels, err
+}
+
+// FadeOut applies a linear fade to silence over the last frames frames of a
+// buffer of samples in the device format, so that playback can end without
+// an audible click. If the buffer holds fewer frames the whole buffer is
+// faded.
+func (d *device) FadeOut(buffer interface{}, frames int) error {
+	if frames < 0 {
+		return errors.New("FadeOut requires a non-negative frame count")
+	}
+	sampleSize := d.formatSampleSize()
+	buf, err := bufferBytes(buffer, sampleSize)
+	if err != nil {
+		return err
+	}
+	frameBytes := d.Channels * sampleSize
+	total := len(buf) / frameBytes
+	if frames > total {
+		frames = total
+	}
+	decode := sampleDecoder(d.Format)
+	encode := sampleEncoder(d.Format)
+	fade := buf[(total-frames)*frameBytes:]
+	for i := 0; i < frames; i++ {
+		gain := float64(frames-1-i) / float64(frames)
+		for c := 0; c < d.Channels; c++ {
+			b := fade[i*frameBytes+c*sampleSize:]
+			encode(b, decode(b)*gain)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"testing"
+
+	"github.com/cocoonlife/testify/assert"
+)
+
+func TestSampleEncoder(t *testing.T) {
+	a := assert.New(t)
+
+	b := make([]byte, 4)
+
+	sampleEncoder(FormatS16LE)(b, 1)
+	a.Equal(b[:2], []byte{0xff, 0x7f}, "S16LE full scale")
+
+	sampleEncoder(FormatS16BE)(b, -1)
+	a.Equal(b[:2], []byte{0x80, 0x01}, "S16BE negative full scale")
+
+	sampleEncoder(FormatU8)(b, 0)
+	a.Equal(b[0], byte(0x80), "U8 silence")
+
+	sampleEncoder(FormatS32LE)(b, 2)
+	a.Equal(b, []byte{0xff, 0xff, 0xff, 0x7f}, "S32LE clipped")
+
+	sampleEncoder(FormatS24LE)(b, -1)
+	a.Equal(b, []byte{0x01, 0x00, 0x80, 0xff}, "S24LE sign extended")
+}
+
+func TestWritePlanarFloat32(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 44100,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.WritePlanarFloat32([][]float32{make([]float32, 100)})
+
+	a.Error(err, "wrong channel count error")
+
+	_, err = p.WritePlanarFloat32([][]float32{make([]float32, 100),
+		make([]float32, 50)})
+
+	a.Error(err, "mismatched length error")
+
+	samples, err := p.WritePlanarFloat32([][]float32{{1, 0}, {-1, 1}})
+
+	a.NoError(err, "buffer written ok")
+	a.Equal(samples, 4, "4 samples written")
+	a.Equal(p.scratch, []byte{0xff, 0x7f, 0x01, 0x80, 0, 0, 0xff, 0x7f},
+		"channels interleaved and converted")
+
+	samples, err = p.WritePlanarFloat32([][]float32{make([]float32, 100),
+		make([]float32, 100)})
+
+	a.NoError(err, "buffer written ok")
+	a.Equal(samples, 200, "200 samples written")
+
+	p.Close()
+}
+
+func TestSampleDecoder(t *testing.T) {
+	a := assert.New(t)
+
+	b := make([]byte, 8)
+	for _, format := range allFormats {
+		for _, v := range []float64{-1, -0.5, 0, 0.25, 1} {
+			sampleEncoder(format)(b, v)
+			a.InDelta(sampleDecoder(format)(b), v, 0.01, "round trip")
+		}
+	}
+}
+
+func TestRMS(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(RMS(nil, FormatS16LE), 0.0, "empty buffer is silent")
+	a.Equal(RMS(make([]byte, 8), FormatS16LE), 0.0, "zero buffer is silent")
+	a.InDelta(RMS([]byte{0xff, 0x7f, 0x01, 0x80}, FormatS16LE), 1.0, 0.0001,
+		"full scale buffer")
+	a.InDelta(RMS([]byte{0x80, 0x80}, FormatU8), 0.0, 0.0001, "unsigned silence")
+}
+
+func TestNormalize(t *testing.T) {
+	a := assert.New(t)
+
+	buf := []int16{1000, -2000, 400}
+
+	a.Error(Normalize(buf, 2, FormatS16LE), "bad peak error")
+	a.Error(Normalize([]int32{0}, 1, FormatS16LE), "wrong type error")
+	a.NoError(Normalize(buf, 1, FormatS16LE), "buffer normalized")
+	a.Equal(buf, []int16{16384, -32767, 6553}, "loudest sample at target")
+
+	silent := []int16{0, 0}
+
+	a.NoError(Normalize(silent, 1, FormatS16LE), "silent buffer ok")
+	a.Equal(silent, []int16{0, 0}, "silence unchanged")
+}
+
+func TestWritePlanar(t *testing.T) {
+	a := assert.New(t)
+
+	p, err := NewPlaybackDevice("null", 2, FormatS16LE, 44100,
+		BufferParams{})
+
+	a.NoError(err, "created playback device")
+
+	_, err = p.WritePlanar([][]int32{make([]int32, 100), make([]int32, 100)})
+
+	a.Error(err, "wrong sample size error")
+
+	_, err = p.WritePlanar([][]float32{make([]float32, 100), make([]float32, 100)})
+
+	a.Error(err, "non integer samples error")
+
+	_, err = p.WritePlanar([][]int16{make([]int16, 100)})
+
+	a.Error(err, "wrong channel count error")
+
+	_, err = p.WritePlanar([][]int16{make([]int16, 100), make([]int16, 50)})
+
+	a.Error(err, "mismatched length error")
+
+	left := []int16{1, 2, 3}
+	right := []int16{-1, -2, -3}
+	samples, err := p.WritePlanar([][]int16{left, right})
+
+	a.NoError(err, "buffer written ok")
+	a.Equal(samples, 6, "6 samples written")
+	a.Equal(p.scratch, []byte{1, 0, 0xff, 0xff, 2, 0, 0xfe, 0xff, 3, 0, 0xfd, 0xff},
+		"channels interleaved")
+
+	p.Close()
+}
+
+func TestFadeOut(t *testing.T) {
+	a := assert.New(t)
+
+	d := &device{Channels: 2, Format: FormatS16LE}
+	buf := []int16{1000, -1000, 1000, -1000, 1000, -1000, 1000, -1000}
+
+	a.Error(d.FadeOut([]int32{0}, 1), "wrong type error")
+	a.Error(d.FadeOut(buf, -1), "negative frames error")
+	a.NoError(d.FadeOut(buf, 2), "buffer faded")
+	a.Equal(buf, []int16{1000, -1000, 1000, -1000, 500, -500, 0, 0}, "last frames faded")
+
+	u := &device{Channels: 1, Format: FormatU8}
+	ubuf := []int8{-1, -1}
+
+	a.NoError(u.FadeOut(ubuf, 10), "whole buffer faded")
+	a.Equal(ubuf[1], int8(-128), "faded to unsigned silence")
+}
@@ -0,0 +1,115 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/*
+#include <alsa/asoundlib.h>
+#include <stdlib.h>
+*/
+import "C"
+
+// CardInfo describes a sound card.
+type CardInfo struct {
+	Index int
+	Name  string
+}
+
+// ListCards lists the sound cards present in the system.
+func ListCards() (cards []CardInfo, err error) {
+	card := C.int(-1)
+	for {
+		ret := C.snd_card_next(&card)
+		if ret < 0 {
+			return nil, createError("could not list cards", ret)
+		}
+		if card < 0 {
+			return
+		}
+		cards = append(cards, CardInfo{Index: int(card), Name: cardName(int(card))})
+	}
+}
+
+// cardName returns the name of a card, or an empty string if it is unknown.
+func cardName(card int) string {
+	var name *C.char
+	if C.snd_card_get_name(C.int(card), &name) < 0 {
+		return ""
+	}
+	defer C.free(unsafe.Pointer(name))
+	return C.GoString(name)
+}
+
+// SubdeviceInfo describes a PCM subdevice of a card.
+type SubdeviceInfo struct {
+	Subdevice int
+	Name      string
+	Playback  bool
+	// Available is the number of subdevices of the device in the same
+	// direction which were free to open at the time they were listed. ALSA
+	// reports how many are free, not which.
+	Available int
+}
+
+// ListSubdevices lists the playback and capture subdevices of a PCM device
+// on a card, reporting how many of them are free to open.
+func ListSubdevices(card, device int) (subdevices []SubdeviceInfo, err error) {
+	ctlName := C.CString(fmt.Sprintf("hw:%d", card))
+	defer C.free(unsafe.Pointer(ctlName))
+	var ctl *C.snd_ctl_t
+	ret := C.snd_ctl_open(&ctl, ctlName, 0)
+	if ret < 0 {
+		return nil, createError(fmt.Sprintf("could not open card %d", card), ret)
+	}
+	defer C.snd_ctl_close(ctl)
+	var info *C.snd_pcm_info_t
+	ret = C.snd_pcm_info_malloc(&info)
+	if ret < 0 {
+		return nil, createError("could not alloc pcm info", ret)
+	}
+	defer C.snd_pcm_info_free(info)
+
+	found := false
+	for _, playback := range []bool{true, false} {
+		stream := C.snd_pcm_stream_t(C.SND_PCM_STREAM_CAPTURE)
+		if playback {
+			stream = C.SND_PCM_STREAM_PLAYBACK
+		}
+		C.snd_pcm_info_set_device(info, C.uint(device))
+		C.snd_pcm_info_set_subdevice(info, 0)
+		C.snd_pcm_info_set_stream(info, stream)
+		ret = C.snd_ctl_pcm_info(ctl, info)
+		if ret == -C.ENOENT {
+			// The device does not support this direction
+			continue
+		} else if ret < 0 {
+			return nil, createError("could not get pcm info", ret)
+		}
+		found = true
+		count := int(C.snd_pcm_info_get_subdevices_count(info))
+		avail := int(C.snd_pcm_info_get_subdevices_avail(info))
+		for i := 0; i < count; i++ {
+			C.snd_pcm_info_set_subdevice(info, C.uint(i))
+			ret = C.snd_ctl_pcm_info(ctl, info)
+			if ret < 0 {
+				return nil, createError("could not get subdevice info", ret)
+			}
+			subdevices = append(subdevices, SubdeviceInfo{
+				Subdevice: i,
+				Name:      C.GoString(C.snd_pcm_info_get_subdevice_name(info)),
+				Playback:  playback,
+				Available: avail,
+			})
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no PCM device %d on card %d", device, card)
+	}
+	return
+}
@@ -0,0 +1,35 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+// DuplexDevice pairs a capture and a playback device opened on the same
+// hardware. Each direction has its own buffer parameters, so that for
+// example capture can use a small buffer for low latency while playback
+// uses a large one to resist underruns.
+type DuplexDevice struct {
+	Capture  *CaptureDevice
+	Playback *PlaybackDevice
+}
+
+// NewDuplexDevice creates a new DuplexDevice object using captureParams and
+// playbackParams for the buffers of the respective directions.
+func NewDuplexDevice(deviceName string, channels int, format Format, rate int, captureParams, playbackParams BufferParams) (d *DuplexDevice, err error) {
+	c, err := NewCaptureDevice(deviceName, channels, format, rate, captureParams)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPlaybackDevice(deviceName, channels, format, rate, playbackParams)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return &DuplexDevice{Capture: c, Playback: p}, nil
+}
+
+// Close closes both directions of the device.
+func (d *DuplexDevice) Close() {
+	d.Capture.Close()
+	d.Playback.Close()
+}
@@ -0,0 +1,29 @@
+// libasound reports internal errors through a printf style variadic
+// handler, which cgo cannot export directly. Format the message here and
+// pass the result on to the Go handler.
+
+#include <stdarg.h>
+
+#include "error_handler.h"
+#include "_cgo_export.h"
+
+static void error_handler(const char *file, int line, const char *function, int err, const char *fmt, ...)
+{
+    char msg[1024];
+    va_list ap;
+
+    va_start(ap, fmt);
+    vsnprintf(msg, sizeof(msg), fmt, ap);
+    va_end(ap);
+    goalsaErrorHandler((char *)file, line, (char *)function, err, msg);
+}
+
+void error_handler_install(void)
+{
+    snd_lib_error_set_handler(error_handler);
+}
+
+void error_handler_remove(void)
+{
+    snd_lib_error_set_handler(NULL);
+}
@@ -0,0 +1,48 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"sync"
+)
+
+/*
+#include "error_handler.h"
+*/
+import "C"
+
+// ErrorHandler receives the internal error messages of the ALSA library.
+// err is the negative error code, or zero if there is none.
+type ErrorHandler func(file string, line int, function string, err int, msg string)
+
+var (
+	errorHandlerMu sync.RWMutex
+	errorHandler   ErrorHandler
+)
+
+// SetErrorHandler routes the internal error messages of the ALSA library,
+// which are normally printed to stderr, to handler. A handler which does
+// nothing suppresses the messages, a nil handler restores printing them to
+// stderr.
+func SetErrorHandler(handler ErrorHandler) {
+	errorHandlerMu.Lock()
+	defer errorHandlerMu.Unlock()
+	errorHandler = handler
+	if handler != nil {
+		C.error_handler_install()
+	} else {
+		C.error_handler_remove()
+	}
+}
+
+//export goalsaErrorHandler
+func goalsaErrorHandler(file *C.char, line C.int, function *C.char, err C.int, msg *C.char) {
+	errorHandlerMu.RLock()
+	handler := errorHandler
+	errorHandlerMu.RUnlock()
+	if handler != nil {
+		handler(C.GoString(file), int(line), C.GoString(function), int(err), C.GoString(msg))
+	}
+}
@@ -0,0 +1,6 @@
+#pragma once
+
+#include <alsa/asoundlib.h>
+
+void error_handler_install(void);
+void error_handler_remove(void);
@@ -0,0 +1,124 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+/*
+#include <alsa/asoundlib.h>
+*/
+import "C"
+
+// formatWidth returns the number of significant bits in a sample.
+func formatWidth(format Format) int {
+	switch format {
+	case FormatS24LE, FormatS24BE, FormatU24LE, FormatU24BE:
+		// Stored in the low three bytes of four
+		return 24
+	}
+	return sampleSize(format) * 8
+}
+
+// isFloatFormat reports whether samples in a format are floating point.
+func isFloatFormat(format Format) bool {
+	switch format {
+	case FormatFloatLE, FormatFloatBE, FormatFloat64LE, FormatFloat64BE:
+		return true
+	}
+	return false
+}
+
+// isUnsignedFormat reports whether samples in a format are unsigned
+// integers.
+func isUnsignedFormat(format Format) bool {
+	switch format {
+	case FormatU8, FormatU16LE, FormatU16BE, FormatU24LE, FormatU24BE, FormatU32LE, FormatU32BE:
+		return true
+	}
+	return false
+}
+
+// isBigEndianFormat reports whether samples in a format are stored most
+// significant byte first.
+func isBigEndianFormat(format Format) bool {
+	switch format {
+	case FormatS16BE, FormatU16BE, FormatS24BE, FormatU24BE, FormatS32BE, FormatU32BE, FormatFloatBE, FormatFloat64BE:
+		return true
+	}
+	return false
+}
+
+// closestFormat returns the format from supported which is closest to
+// requested. Candidates are ranked first by matching integer or float
+// samples, then by being at least as wide, then by matching signedness,
+// then byte order, and finally by the nearest width.
+func closestFormat(requested Format, supported []Format) (closest Format, ok bool) {
+	rank := func(format Format) (r [5]int) {
+		if isFloatFormat(format) != isFloatFormat(requested) {
+			r[0] = 1
+		}
+		if formatWidth(format) < formatWidth(requested) {
+			r[1] = 1
+		}
+		if isUnsignedFormat(format) != isUnsignedFormat(requested) {
+			r[2] = 1
+		}
+		if isBigEndianFormat(format) != isBigEndianFormat(requested) {
+			r[3] = 1
+		}
+		r[4] = formatWidth(format) - formatWidth(requested)
+		if r[4] < 0 {
+			r[4] = -r[4]
+		}
+		return
+	}
+	var best [5]int
+	for _, format := range supported {
+		if format == requested {
+			return format, true
+		}
+		r := rank(format)
+		if !ok || lessRank(r, best) {
+			closest, best, ok = format, r, true
+		}
+	}
+	return
+}
+
+func lessRank(a, b [5]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// FormatsByWidth returns the supported formats whose samples have the given
+// number of significant bits, for example all the 16-bit formats.
+func FormatsByWidth(bits int) (formats []Format) {
+	for _, format := range allFormats {
+		if formatWidth(format) == bits {
+			formats = append(formats, format)
+		}
+	}
+	return
+}
+
+// FloatFormats returns the supported floating point formats.
+func FloatFormats() (formats []Format) {
+	for _, format := range allFormats {
+		if isFloatFormat(format) {
+			formats = append(formats, format)
+		}
+	}
+	return
+}
+
+// IsHostEndianCompatible reports whether samples in the device format are
+// stored in the byte order of the host, so that native Go integer and float
+// slices can be used without swapping. Single byte formats are always
+// compatible.
+func (d *device) IsHostEndianCompatible() bool {
+	return C.snd_pcm_format_cpu_endian(C.snd_pcm_format_t(d.Format)) != 0
+}
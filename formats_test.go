@@ -0,0 +1,64 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"testing"
+
+	"github.com/cocoonlife/testify/assert"
+)
+
+func TestFormatsByWidth(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(FormatsByWidth(16), []Format{FormatS16LE, FormatS16BE,
+		FormatU16LE, FormatU16BE}, "16-bit formats")
+	a.Equal(FormatsByWidth(24), []Format{FormatS24LE, FormatS24BE,
+		FormatU24LE, FormatU24BE}, "24-bit formats")
+	a.Len(FormatsByWidth(32), 6, "32-bit integer and float formats")
+	a.Len(FormatsByWidth(12), 0, "no 12-bit formats")
+
+	a.Equal(FloatFormats(), []Format{FormatFloatLE, FormatFloatBE,
+		FormatFloat64LE, FormatFloat64BE}, "float formats")
+}
+
+func TestIsHostEndianCompatible(t *testing.T) {
+	a := assert.New(t)
+
+	a.True((&device{Format: FormatS8}).IsHostEndianCompatible(), "single byte compatible")
+	a.NotEqual((&device{Format: FormatS16LE}).IsHostEndianCompatible(),
+		(&device{Format: FormatS16BE}).IsHostEndianCompatible(), "one byte order compatible")
+	a.Equal((&device{Format: FormatS16LE}).IsHostEndianCompatible(),
+		(&device{Format: FormatFloat64LE}).IsHostEndianCompatible(), "same byte order agrees")
+}
+
+func TestClosestFormat(t *testing.T) {
+	a := assert.New(t)
+
+	_, ok := closestFormat(FormatS16LE, nil)
+
+	a.False(ok, "no supported formats")
+
+	closest, ok := closestFormat(FormatS16LE, []Format{FormatS16BE, FormatS32LE, FormatS16LE})
+
+	a.True(ok, "format found")
+	a.Equal(closest, Format(FormatS16LE), "requested format preferred")
+
+	closest, _ = closestFormat(FormatS16LE, []Format{FormatS16BE, FormatFloatLE, FormatS32LE})
+
+	a.Equal(closest, Format(FormatS32LE), "wider format of same family and order preferred")
+
+	closest, _ = closestFormat(FormatS32LE, []Format{FormatS24LE, FormatU32LE, FormatS32BE, FormatFloatLE})
+
+	a.Equal(closest, Format(FormatS32BE), "same width and signedness preferred")
+
+	closest, _ = closestFormat(FormatFloatLE, []Format{FormatS32LE, FormatFloat64LE})
+
+	a.Equal(closest, Format(FormatFloat64LE), "float preferred for float")
+
+	closest, _ = closestFormat(FormatS16LE, []Format{FormatFloatLE, FormatS8})
+
+	a.Equal(closest, Format(FormatS8), "integer preferred for integer")
+}
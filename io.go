@@ -0,0 +1,79 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+	"io"
+	"unsafe"
+)
+
+// errPartialFrame is returned for byte buffers which do not hold a whole
+// number of frames.
+var errPartialFrame = errors.New("buffer length must be a multiple of the frame size")
+
+// WriteBytes writes the whole of a buffer of bytes in the device format to
+// a playback device and returns the number of bytes written. The buffer
+// must hold a whole number of frames.
+func (p *PlaybackDevice) WriteBytes(buffer []byte) (n int, err error) {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return 0, ErrClosed
+	}
+	frameBytes := p.Channels * p.formatSampleSize()
+	if len(buffer)%frameBytes != 0 {
+		return 0, errPartialFrame
+	}
+	frames, err := p.writeAll(buffer)
+	return frames * frameBytes, err
+}
+
+// ReadBytes reads into a buffer of bytes in the device format and returns
+// the number of bytes read. The buffer must hold a whole number of frames.
+func (c *CaptureDevice) ReadBytes(buffer []byte) (n int, err error) {
+	c.lock()
+	defer c.unlock()
+	if c.h == nil {
+		return 0, ErrClosed
+	}
+	frameBytes := c.Channels * c.formatSampleSize()
+	if len(buffer)%frameBytes != 0 {
+		return 0, errPartialFrame
+	}
+	if len(buffer) == 0 {
+		return 0, nil
+	}
+	frames, err := c.readFrames(unsafe.Pointer(&buffer[0]), len(buffer)/frameBytes)
+	return frames * frameBytes, err
+}
+
+type playbackWriter struct {
+	p *PlaybackDevice
+}
+
+func (w playbackWriter) Write(b []byte) (int, error) {
+	return w.p.WriteBytes(b)
+}
+
+type captureReader struct {
+	c *CaptureDevice
+}
+
+func (r captureReader) Read(b []byte) (int, error) {
+	return r.c.ReadBytes(b)
+}
+
+// Writer returns an io.Writer which writes bytes in the device format to
+// the device using WriteBytes.
+func (p *PlaybackDevice) Writer() io.Writer {
+	return playbackWriter{p}
+}
+
+// Reader returns an io.Reader which reads bytes in the device format from
+// the device using ReadBytes.
+func (c *CaptureDevice) Reader() io.Reader {
+	return captureReader{c}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+	"math"
+	"time"
+	"unsafe"
+)
+
+// RMS returns the root mean square level of a buffer of samples in the
+// given format, in the range 0 (silence) to 1 (full scale).
+func RMS(buffer []byte, format Format) float64 {
+	size := sampleSize(format)
+	samples := len(buffer) / size
+	if samples == 0 {
+		return 0
+	}
+	decode := sampleDecoder(format)
+	var sum float64
+	for i := 0; i < samples; i++ {
+		v := decode(buffer[i*size:])
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(samples))
+}
+
+// Normalize scales a buffer of samples in the given format in place so that
+// its loudest sample reaches targetPeak, in the range 0 to 1. A silent
+// buffer is left unchanged.
+func Normalize(buffer interface{}, targetPeak float64, format Format) error {
+	if targetPeak < 0 || targetPeak > 1 {
+		return errors.New("target peak must be between 0 and 1")
+	}
+	size := sampleSize(format)
+	buf, err := bufferBytes(buffer, size)
+	if err != nil {
+		return err
+	}
+	samples := len(buf) / size
+	decode := sampleDecoder(format)
+	var peak float64
+	for i := 0; i < samples; i++ {
+		peak = math.Max(peak, math.Abs(decode(buf[i*size:])))
+	}
+	if peak == 0 {
+		return nil
+	}
+	gain := targetPeak / peak
+	encode := sampleEncoder(format)
+	for i := 0; i < samples; i++ {
+		b := buf[i*size:]
+		encode(b, decode(b)*gain)
+	}
+	return nil
+}
+
+// ReadUntil reads periods of audio until stop returns true for the RMS level
+// of the most recent period, or until max worth of audio has been captured.
+// It returns all of the audio read in the device format, at most max worth.
+// Audio lost to overruns is skipped but counts towards max.
+func (c *CaptureDevice) ReadUntil(stop func(level float64) bool, max time.Duration) (buffer []byte, err error) {
+	if max <= 0 {
+		return nil, errors.New("max duration must be positive")
+	}
+	frameBytes := c.Channels * c.formatSampleSize()
+	periodFrames := c.BufferParams.PeriodFrames
+	maxFrames := int(max * time.Duration(c.Rate) / time.Second)
+	chunk := make([]byte, periodFrames*frameBytes)
+	frames := 0
+	for frames < maxFrames {
+		n, err := c.readPeriod(chunk, periodFrames)
+		if err == ErrOverrun {
+			// Count the lost audio, so a device which keeps overrunning
+			// still reaches max
+			frames += periodFrames
+			continue
+		} else if err != nil {
+			return buffer, err
+		}
+		if n > maxFrames-frames {
+			n = maxFrames - frames
+		}
+		read := chunk[:n*frameBytes]
+		buffer = append(buffer, read...)
+		frames += n
+		if stop(RMS(read, c.Format)) {
+			break
+		}
+	}
+	return buffer, nil
+}
+
+func (c *CaptureDevice) readPeriod(chunk []byte, frames int) (int, error) {
+	c.lock()
+	defer c.unlock()
+	if c.h == nil {
+		return 0, ErrClosed
+	}
+	return c.readFrames(unsafe.Pointer(&chunk[0]), frames)
+}
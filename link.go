@@ -0,0 +1,114 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+)
+
+/*
+#include <alsa/asoundlib.h>
+*/
+import "C"
+
+// LinkDevices links the given playback devices so that starting, stopping
+// or preparing any one of them acts on all of them. If linking fails the
+// devices are left unlinked.
+func LinkDevices(devices ...*PlaybackDevice) error {
+	if len(devices) < 2 {
+		return errors.New("at least two devices are required to link")
+	}
+	for _, p := range devices {
+		if p.h == nil {
+			return ErrClosed
+		}
+	}
+	for i, p := range devices[1:] {
+		ret := devices[0].pcm().link(devices[0].h, p.h)
+		if ret < 0 {
+			UnlinkDevices(devices[:i+1]...)
+			return createError("could not link devices", C.int(ret))
+		}
+	}
+	return nil
+}
+
+// UnlinkDevices removes the given playback devices from any link group.
+func UnlinkDevices(devices ...*PlaybackDevice) error {
+	for _, p := range devices {
+		if p.h == nil {
+			return ErrClosed
+		}
+		ret := p.pcm().unlink(p.h)
+		if ret < 0 && ret != -C.EALREADY {
+			return createError("could not unlink device", C.int(ret))
+		}
+	}
+	return nil
+}
+
+// SynchronizedStart starts the given playback devices on the same hardware
+// tick. The devices are prepared, linked and each is pre-filled with
+// silence up to its start threshold before a single start is issued for
+// the whole group. On return the devices remain linked, any previous links
+// are replaced so that the same group may be started again.
+func SynchronizedStart(devices ...*PlaybackDevice) error {
+	if len(devices) == 0 {
+		return errors.New("no devices to start")
+	}
+	thresholds := make([]int, len(devices))
+	for i, p := range devices {
+		if p.h == nil {
+			return ErrClosed
+		}
+		ret := C.snd_pcm_prepare(p.h)
+		if ret < 0 {
+			return createError("could not prepare device", ret)
+		}
+		threshold, err := p.startThreshold()
+		if err != nil {
+			return err
+		}
+		if threshold > p.BufferParams.BufferFrames {
+			threshold = p.BufferParams.BufferFrames
+		}
+		thresholds[i] = threshold
+	}
+	if len(devices) > 1 {
+		// Linking a device which is already linked fails
+		if err := UnlinkDevices(devices...); err != nil {
+			return err
+		}
+		if err := LinkDevices(devices...); err != nil {
+			return err
+		}
+	}
+	// restore puts back the start thresholds of the first n devices
+	restore := func(n int) (err error) {
+		for i, p := range devices[:n] {
+			if rerr := p.setStartThreshold(thresholds[i]); rerr != nil && err == nil {
+				err = rerr
+			}
+		}
+		return
+	}
+	// Stop the pre-fill from starting any device early
+	for i, p := range devices {
+		err := p.setStartThreshold(-1)
+		if err == nil {
+			err = p.writeSilence(thresholds[i])
+		}
+		if err != nil {
+			restore(i + 1)
+			return err
+		}
+	}
+	ret := C.snd_pcm_start(devices[0].h)
+	err := restore(len(devices))
+	if ret < 0 {
+		return createError("could not start devices", ret)
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// The directory holding the ALSA device nodes, one control node per card.
+// It is a variable so that tests can use a temporary directory.
+var sndDevDir = "/dev/snd"
+
+// CardEvent reports a sound card being added to or removed from the system.
+type CardEvent struct {
+	CardInfo
+	Removed bool
+}
+
+// Monitor watches for sound cards being added and removed, for example when
+// a USB audio device is plugged in.
+type Monitor struct {
+	fd        int
+	file      *os.File
+	events    chan CardEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	names     map[int]string
+	// sndWatch watches sndDevDir, it is -1 while the directory does not
+	// exist, in which case dirWatch waits for it to be created
+	sndWatch int
+	dirWatch int
+}
+
+// NewMonitor creates a Monitor which watches for card events until closed.
+// The device directory need not exist yet, as on a system which has never
+// had a sound card, in which case it is watched for once it appears.
+func NewMonitor() (m *Monitor, err error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	dirWatch, err := syscall.InotifyAddWatch(fd, filepath.Dir(sndDevDir), syscall.IN_CREATE|syscall.IN_ONLYDIR)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	m = &Monitor{
+		fd:       fd,
+		file:     os.NewFile(uintptr(fd), "inotify"),
+		events:   make(chan CardEvent),
+		done:     make(chan struct{}),
+		names:    make(map[int]string),
+		sndWatch: -1,
+		dirWatch: dirWatch,
+	}
+	// Watch before checking which cards exist, so that none are missed
+	if err = m.watchSndDir(); err != nil && !os.IsNotExist(err) {
+		m.file.Close()
+		return nil, err
+	}
+	// Remember the names of existing cards so removals can be reported
+	// with them
+	cards, _ := ListCards()
+	for _, card := range cards {
+		m.names[card.Index] = card.Name
+	}
+	go m.loop()
+	return m, nil
+}
+
+// watchSndDir starts watching the device directory for control nodes.
+func (m *Monitor) watchSndDir() error {
+	wd, err := syscall.InotifyAddWatch(m.fd, sndDevDir, syscall.IN_CREATE|syscall.IN_DELETE|syscall.IN_ONLYDIR)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	m.sndWatch = wd
+	return nil
+}
+
+// Events returns the channel on which card events are delivered. The
+// channel is closed when the monitor is closed.
+func (m *Monitor) Events() <-chan CardEvent {
+	return m.events
+}
+
+// Close stops the monitor.
+func (m *Monitor) Close() (err error) {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		err = m.file.Close()
+	})
+	return
+}
+
+func (m *Monitor) loop() {
+	defer close(m.events)
+	buf := make([]byte, 4096)
+	for {
+		n, err := m.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameBytes := buf[nameStart : nameStart+int(event.Len)]
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			offset = nameStart + int(event.Len)
+
+			switch {
+			case int(event.Wd) == m.dirWatch:
+				if name == filepath.Base(sndDevDir) && m.sndWatch < 0 {
+					if !m.sndDirCreated() {
+						return
+					}
+				}
+			case int(event.Wd) == m.sndWatch:
+				if event.Mask&syscall.IN_IGNORED != 0 {
+					// The directory was removed
+					m.sndWatch = -1
+					continue
+				}
+				card, ok := controlCard(name)
+				if !ok {
+					continue
+				}
+				if !m.send(card, event.Mask&syscall.IN_DELETE != 0) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// sndDirCreated starts watching a newly created device directory and
+// reports the cards whose nodes appeared before the watch was added. It
+// returns false if the monitor was closed.
+func (m *Monitor) sndDirCreated() bool {
+	if m.watchSndDir() != nil {
+		return true
+	}
+	files, _ := ioutil.ReadDir(sndDevDir)
+	for _, file := range files {
+		card, ok := controlCard(file.Name())
+		if !ok {
+			continue
+		}
+		if !m.send(card, false) {
+			return false
+		}
+	}
+	return true
+}
+
+// send delivers an event for a card being added or removed, returning
+// false if the monitor was closed. Cards already known to be present are
+// not reported again.
+func (m *Monitor) send(card int, removed bool) bool {
+	ev := CardEvent{CardInfo: CardInfo{Index: card}}
+	if _, known := m.names[card]; known && !removed {
+		return true
+	}
+	if removed {
+		ev.Name = m.names[card]
+		ev.Removed = true
+		delete(m.names, card)
+	} else {
+		ev.Name = cardName(card)
+		m.names[card] = ev.Name
+	}
+	select {
+	case m.events <- ev:
+		return true
+	case <-m.done:
+		return false
+	}
+}
+
+// controlCard returns the card index for a control device node name such
+// as controlC1.
+func controlCard(name string) (card int, ok bool) {
+	if !strings.HasPrefix(name, "controlC") {
+		return 0, false
+	}
+	card, err := strconv.Atoi(strings.TrimPrefix(name, "controlC"))
+	if err != nil {
+		return 0, false
+	}
+	return card, true
+}
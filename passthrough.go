@@ -0,0 +1,42 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"unsafe"
+)
+
+// ReadPassthrough reads whole frames into a buffer of bytes in the device
+// format and returns the number of frames read. Unlike Read the buffer is
+// not checked against the format, so that captured audio can be forwarded
+// to another device cheaply.
+func (c *CaptureDevice) ReadPassthrough(buffer []byte) (frames int, err error) {
+	c.lock()
+	defer c.unlock()
+	if c.h == nil {
+		return 0, ErrClosed
+	}
+	frames = len(buffer) / (c.Channels * c.formatSampleSize())
+	if frames == 0 {
+		return 0, nil
+	}
+	return c.readFrames(unsafe.Pointer(&buffer[0]), frames)
+}
+
+// WritePassthrough writes whole frames from a buffer of bytes assumed to be
+// in the device format and returns the number of frames written. Any
+// trailing partial frame is ignored.
+func (p *PlaybackDevice) WritePassthrough(buffer []byte) (frames int, err error) {
+	p.lock()
+	defer p.unlock()
+	if p.h == nil {
+		return 0, ErrClosed
+	}
+	frames = len(buffer) / (p.Channels * p.formatSampleSize())
+	if frames == 0 {
+		return 0, nil
+	}
+	return p.writeFrames(unsafe.Pointer(&buffer[0]), frames)
+}
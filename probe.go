@@ -0,0 +1,162 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+#include <alsa/asoundlib.h>
+*/
+import "C"
+
+// probeHwParams opens a device and passes its unrestricted interleaved
+// hardware parameters to fn, so that fn can discover what the hardware
+// supports. The device is always closed again before returning.
+func probeHwParams(deviceName string, playback bool, fn func(h *C.snd_pcm_t, hwParams *C.snd_pcm_hw_params_t) error) error {
+	var stream C.snd_pcm_stream_t = C.SND_PCM_STREAM_CAPTURE
+	if playback {
+		stream = C.SND_PCM_STREAM_PLAYBACK
+	}
+	h, openRet := openPCM(deviceName, stream, 0)
+	if openRet < 0 {
+		return fmt.Errorf("could not open ALSA device %s", deviceName)
+	}
+	defer C.snd_pcm_close(h)
+	var hwParams *C.snd_pcm_hw_params_t
+	ret := C.snd_pcm_hw_params_malloc(&hwParams)
+	if ret < 0 {
+		return createError("could not alloc hw params", ret)
+	}
+	defer C.snd_pcm_hw_params_free(hwParams)
+	ret = C.snd_pcm_hw_params_any(h, hwParams)
+	if ret < 0 {
+		return createError("could not set default hw params", ret)
+	}
+	ret = C.snd_pcm_hw_params_set_access(h, hwParams, C.SND_PCM_ACCESS_RW_INTERLEAVED)
+	if ret < 0 {
+		return createError("could not set access params", ret)
+	}
+	return fn(h, hwParams)
+}
+
+// The number of periods recommended when the hardware allows it; enough
+// that a late wakeup still leaves audio queued, few enough that each
+// period is not tiny.
+const recommendedPeriods = 4
+
+// RecommendPeriods probes a playback device and recommends a period count
+// for a buffer holding the given latency of audio. Four periods are
+// recommended where possible, fewer if the periods would otherwise be
+// smaller than the hardware supports, and never fewer than two.
+func RecommendPeriods(deviceName string, channels int, format Format, rate int, latency time.Duration) (periods int, err error) {
+	if latency <= 0 {
+		return 0, errors.New("latency must be positive")
+	}
+	err = probeHwParams(deviceName, true, func(h *C.snd_pcm_t, hwParams *C.snd_pcm_hw_params_t) error {
+		ret := C.snd_pcm_hw_params_set_format(h, hwParams, C.snd_pcm_format_t(format))
+		if ret < 0 {
+			return createError("could not set format params", ret)
+		}
+		ret = C.snd_pcm_hw_params_set_channels(h, hwParams, C.uint(channels))
+		if ret < 0 {
+			return createError("could not set channels params", ret)
+		}
+		ret = C.snd_pcm_hw_params_set_rate(h, hwParams, C.uint(rate), 0)
+		if ret < 0 {
+			return createError("could not set rate params", ret)
+		}
+		var bufferSize = C.snd_pcm_uframes_t(latency * time.Duration(rate) / time.Second)
+		ret = C.snd_pcm_hw_params_set_buffer_size_near(h, hwParams, &bufferSize)
+		if ret < 0 {
+			return createError("could not set buffer size", ret)
+		}
+		var periodMin C.snd_pcm_uframes_t
+		ret = C.snd_pcm_hw_params_get_period_size_min(hwParams, &periodMin, nil)
+		if ret < 0 {
+			return createError("could not get period size", ret)
+		}
+		var periodsMin, periodsMax C.uint
+		ret = C.snd_pcm_hw_params_get_periods_min(hwParams, &periodsMin, nil)
+		if ret < 0 {
+			return createError("could not get periods", ret)
+		}
+		ret = C.snd_pcm_hw_params_get_periods_max(hwParams, &periodsMax, nil)
+		if ret < 0 {
+			return createError("could not get periods", ret)
+		}
+
+		periods = recommendedPeriods
+		if periodMin > 0 && int(bufferSize/periodMin) < periods {
+			periods = int(bufferSize / periodMin)
+		}
+		if periods < 2 {
+			periods = 2
+		}
+		if periods < int(periodsMin) {
+			periods = int(periodsMin)
+		}
+		if periodsMax > 0 && periods > int(periodsMax) {
+			periods = int(periodsMax)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return periods, nil
+}
+
+// Capabilities describes the configurations a device supports.
+type Capabilities struct {
+	Formats     []Format
+	MinRate     int
+	MaxRate     int
+	MinChannels int
+	MaxChannels int
+}
+
+// QueryCapabilities probes a device for the sample formats, rates and
+// channel counts it supports, without leaving it open.
+func QueryCapabilities(deviceName string, playback bool) (caps *Capabilities, err error) {
+	caps = new(Capabilities)
+	err = probeHwParams(deviceName, playback, func(h *C.snd_pcm_t, hwParams *C.snd_pcm_hw_params_t) error {
+		for _, format := range allFormats {
+			if C.snd_pcm_hw_params_test_format(h, hwParams, C.snd_pcm_format_t(format)) == 0 {
+				caps.Formats = append(caps.Formats, format)
+			}
+		}
+		var rateMin, rateMax C.uint
+		ret := C.snd_pcm_hw_params_get_rate_min(hwParams, &rateMin, nil)
+		if ret < 0 {
+			return createError("could not get rate min", ret)
+		}
+		ret = C.snd_pcm_hw_params_get_rate_max(hwParams, &rateMax, nil)
+		if ret < 0 {
+			return createError("could not get rate max", ret)
+		}
+		var channelsMin, channelsMax C.uint
+		ret = C.snd_pcm_hw_params_get_channels_min(hwParams, &channelsMin)
+		if ret < 0 {
+			return createError("could not get channels min", ret)
+		}
+		ret = C.snd_pcm_hw_params_get_channels_max(hwParams, &channelsMax)
+		if ret < 0 {
+			return createError("could not get channels max", ret)
+		}
+		caps.MinRate = int(rateMin)
+		caps.MaxRate = int(rateMax)
+		caps.MinChannels = int(channelsMin)
+		caps.MaxChannels = int(channelsMax)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return caps, nil
+}
@@ -0,0 +1,258 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+/*
+#include <alsa/asoundlib.h>
+#include <pthread.h>
+#include <sched.h>
+
+static int set_fifo_priority(int priority)
+{
+    struct sched_param sched_param;
+    if (priority <= 0) {
+        priority = sched_get_priority_max(SCHED_FIFO);
+    }
+    sched_param.sched_priority = priority;
+    return pthread_setschedparam(pthread_self(), SCHED_FIFO, &sched_param);
+}
+*/
+import "C"
+
+// RealtimeOptions specifies the behaviour of a RealtimePlayer.
+type RealtimeOptions struct {
+	// Priority is the SCHED_FIFO priority of the writer thread, zero
+	// selects the maximum priority.
+	Priority int
+	// RingFrames is the capacity of the ring buffer filled by Push. It
+	// defaults to twice the device buffer size.
+	RingFrames int
+}
+
+// RealtimePlayer owns a PlaybackDevice and feeds it from a dedicated
+// real-time thread. Audio is queued with Push into a lock-free ring buffer
+// and written to the device a period at a time. If the ring runs dry the
+// thread writes silence rather than letting the device underrun.
+type RealtimePlayer struct {
+	p          *PlaybackDevice
+	ring       []byte
+	frameBytes int
+	// head and tail count bytes pushed and consumed, they are accessed
+	// atomically; only Push advances head and only the writer thread
+	// advances tail
+	head          uint64
+	tail          uint64
+	silenceFrames uint64
+	realtime      int32
+	err           atomic.Value
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+// NewRealtimePlayer takes ownership of p and starts the writer thread. The
+// thread runs with real-time priority if the process is permitted to
+// request it, otherwise with normal priority, see Realtime.
+func NewRealtimePlayer(p *PlaybackDevice, options RealtimeOptions) (r *RealtimePlayer, err error) {
+	if p.h == nil {
+		return nil, ErrClosed
+	}
+	ringFrames := options.RingFrames
+	if ringFrames <= 0 {
+		ringFrames = 2 * p.BufferParams.BufferFrames
+	}
+	if ringFrames < p.BufferParams.PeriodFrames {
+		return nil, errors.New("ring buffer must hold at least a period")
+	}
+	frameBytes := p.Channels * p.formatSampleSize()
+	r = &RealtimePlayer{
+		p:          p,
+		ring:       make([]byte, ringFrames*frameBytes),
+		frameBytes: frameBytes,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	started := make(chan struct{})
+	go r.writeLoop(options.Priority, started)
+	<-started
+	return r, nil
+}
+
+// Push queues a buffer of samples for playback without blocking and
+// returns the number of samples accepted, which is less than the buffer
+// length if the ring buffer is full. Buffers use the same sample types as
+// PlaybackDevice.Write. Push must not be called concurrently with itself.
+func (r *RealtimePlayer) Push(buffer interface{}) (samples int, err error) {
+	if err, ok := r.err.Load().(error); ok {
+		return 0, err
+	}
+	sampleSize := r.p.formatSampleSize()
+	in, err := bufferBytes(buffer, sampleSize)
+	if err != nil {
+		return 0, err
+	}
+	head := atomic.LoadUint64(&r.head)
+	free := len(r.ring) - int(head-atomic.LoadUint64(&r.tail))
+	n := len(in) / r.frameBytes * r.frameBytes
+	if n > free {
+		n = free / r.frameBytes * r.frameBytes
+	}
+	start := int(head % uint64(len(r.ring)))
+	copied := copy(r.ring[start:], in[:n])
+	copy(r.ring, in[copied:n])
+	atomic.StoreUint64(&r.head, head+uint64(n))
+	return n / sampleSize, nil
+}
+
+// Buffered returns the number of frames pushed but not yet written to the
+// device.
+func (r *RealtimePlayer) Buffered() int {
+	return int(atomic.LoadUint64(&r.head)-atomic.LoadUint64(&r.tail)) / r.frameBytes
+}
+
+// Latency returns the time until a frame pushed now would be played, the
+// audio waiting in the ring buffer plus the delay reported by the device.
+func (r *RealtimePlayer) Latency() time.Duration {
+	frames := r.Buffered()
+	r.p.lock()
+	if r.p.h != nil {
+		var delay C.snd_pcm_sframes_t
+		if C.snd_pcm_delay(r.p.h, &delay) == 0 && delay > 0 {
+			frames += int(delay)
+		}
+	}
+	r.p.unlock()
+	return time.Duration(frames) * time.Second / time.Duration(r.p.Rate)
+}
+
+// Underruns returns the number of underruns the device has recovered from.
+func (r *RealtimePlayer) Underruns() int {
+	return r.p.Underruns()
+}
+
+// SilenceFrames returns the number of frames of silence written because
+// the ring buffer ran dry.
+func (r *RealtimePlayer) SilenceFrames() int {
+	return int(atomic.LoadUint64(&r.silenceFrames))
+}
+
+// Realtime reports whether the writer thread was granted real-time
+// priority.
+func (r *RealtimePlayer) Realtime() bool {
+	return atomic.LoadInt32(&r.realtime) != 0
+}
+
+// Err returns the error which stopped the writer thread, if any.
+func (r *RealtimePlayer) Err() error {
+	err, _ := r.err.Load().(error)
+	return err
+}
+
+// Close stops the writer thread and closes the device. Audio still in the
+// ring buffer is discarded.
+func (r *RealtimePlayer) Close() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+	r.p.Close()
+}
+
+func (r *RealtimePlayer) writeLoop(priority int, started chan struct{}) {
+	defer close(r.done)
+	// The thread is never unlocked, so that Go terminates it rather than
+	// reusing a real-time thread for other goroutines
+	runtime.LockOSThread()
+	if C.set_fifo_priority(C.int(priority)) == 0 {
+		atomic.StoreInt32(&r.realtime, 1)
+	}
+	close(started)
+
+	p := r.p
+	frames := p.BufferParams.PeriodFrames
+	period := make([]byte, frames*r.frameBytes)
+	periodPtr := unsafe.Pointer(&period[0])
+	silence := make([]byte, len(period))
+	silencePtr := unsafe.Pointer(&silence[0])
+	C.snd_pcm_format_set_silence(C.snd_pcm_format_t(p.Format), silencePtr, C.uint(frames*p.Channels))
+	// Poll four times per period while the device has enough queued
+	interval := time.Duration(frames) * time.Second / time.Duration(p.Rate) / 4
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+		ptr := periodPtr
+		writable, needsData := r.deviceStatus(frames)
+		if writable && r.Buffered() >= frames {
+			r.take(period)
+		} else if needsData {
+			ptr = silencePtr
+		} else {
+			time.Sleep(interval)
+			continue
+		}
+		p.lock()
+		written, err := p.writeFrames(ptr, frames)
+		p.unlock()
+		if err == ErrUnderrun {
+			continue
+		} else if err != nil {
+			r.err.Store(err)
+			return
+		}
+		if ptr == silencePtr {
+			atomic.AddUint64(&r.silenceFrames, uint64(written))
+		}
+	}
+}
+
+// take copies len(dst) bytes from the head of the ring into dst and
+// releases the space for Push.
+func (r *RealtimePlayer) take(dst []byte) {
+	tail := atomic.LoadUint64(&r.tail)
+	start := int(tail % uint64(len(r.ring)))
+	n := copy(dst, r.ring[start:])
+	copy(dst[n:], r.ring)
+	atomic.StoreUint64(&r.tail, tail+uint64(len(dst)))
+}
+
+// deviceStatus reports whether the device can accept audio, and whether
+// less than the given number of frames remain queued in a running device
+// so that it must be fed to avoid an underrun. A device which has underrun
+// is prepared and needs feeding. A paused, suspended or stopped device
+// accepts nothing.
+func (r *RealtimePlayer) deviceStatus(frames int) (writable, needsData bool) {
+	r.p.lock()
+	defer r.p.unlock()
+	if r.p.h == nil {
+		return false, false
+	}
+	switch C.snd_pcm_state(r.p.h) {
+	case C.SND_PCM_STATE_PREPARED:
+		return true, false
+	case C.SND_PCM_STATE_RUNNING:
+		avail := C.snd_pcm_avail(r.p.h)
+		return true, avail >= 0 && int(avail) > r.p.BufferParams.BufferFrames-frames
+	case C.SND_PCM_STATE_XRUN:
+		r.p.countXrun()
+		if C.snd_pcm_prepare(r.p.h) < 0 {
+			return false, false
+		}
+		return true, true
+	}
+	return false, false
+}
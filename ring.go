@@ -0,0 +1,203 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+)
+
+/*
+#include <alsa/asoundlib.h>
+*/
+import "C"
+
+// captureRing is a software buffer filled from the hardware by a
+// background goroutine. It starts small and grows as needed up to a
+// maximum size, so a consumer which stalls briefly does not cause the
+// hardware to overrun.
+type captureRing struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	start   int
+	length  int
+	max     int
+	overrun bool
+	err     error
+	stopped bool
+	done    chan struct{}
+}
+
+// StartRingBuffer starts a goroutine which continuously reads from the
+// hardware into a software ring buffer holding up to maxFrames frames.
+// Subsequent reads are served from the ring buffer and may be of any size.
+// If the ring buffer fills the next read returns ErrOverrun and the
+// buffered audio is discarded.
+func (c *CaptureDevice) StartRingBuffer(maxFrames int) error {
+	if c.h == nil {
+		return ErrClosed
+	}
+	if c.ring != nil {
+		return errors.New("ring buffer already running")
+	}
+	if c.readerThread != nil {
+		return errors.New("Reader thread already running")
+	}
+	frameBytes := c.Channels * c.formatSampleSize()
+	if maxFrames < c.BufferParams.PeriodFrames {
+		return errors.New("ring buffer must hold at least a period")
+	}
+	r := &captureRing{
+		// Start with room for a few periods and grow on demand
+		buf:  make([]byte, 4*c.PeriodBytes()),
+		max:  maxFrames * frameBytes,
+		done: make(chan struct{}),
+	}
+	if len(r.buf) > r.max {
+		r.buf = r.buf[:r.max]
+	}
+	r.cond = sync.NewCond(&r.mu)
+	c.ring = r
+	go c.ringLoop(r)
+	return nil
+}
+
+// RingBufferLevel returns the number of frames held in the ring buffer and
+// the number of frames it can currently hold before growing.
+func (c *CaptureDevice) RingBufferLevel() (frames, capacity int) {
+	r := c.ring
+	if r == nil {
+		return 0, 0
+	}
+	frameBytes := c.Channels * c.formatSampleSize()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.length / frameBytes, len(r.buf) / frameBytes
+}
+
+func (c *CaptureDevice) ringLoop(r *captureRing) {
+	defer close(r.done)
+	period := make([]byte, c.PeriodBytes())
+	periodPtr := unsafe.Pointer(&period[0])
+	frameBytes := c.Channels * c.formatSampleSize()
+	for !r.isStopped() {
+		ret := C.snd_pcm_readi(c.h, periodPtr, C.snd_pcm_uframes_t(c.BufferParams.PeriodFrames))
+		if ret == -C.EPIPE {
+			c.countXrun()
+			C.snd_pcm_prepare(c.h)
+			r.setOverrun()
+			continue
+		} else if ret < 0 {
+			r.fail(createError("read error", C.int(ret)))
+			return
+		}
+		r.write(period[:int(ret)*frameBytes])
+	}
+}
+
+func (r *captureRing) isStopped() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopped
+}
+
+func (r *captureRing) setOverrun() {
+	r.mu.Lock()
+	r.overrun = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+}
+
+func (r *captureRing) fail(err error) {
+	r.mu.Lock()
+	r.err = err
+	r.cond.Broadcast()
+	r.mu.Unlock()
+}
+
+// write appends data to the ring, growing it if necessary. Data is dropped
+// while the ring is overrun.
+func (r *captureRing) write(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.overrun {
+		return
+	}
+	if r.length+len(data) > len(r.buf) {
+		if !r.grow(r.length + len(data)) {
+			r.overrun = true
+			r.cond.Broadcast()
+			return
+		}
+	}
+	end := (r.start + r.length) % len(r.buf)
+	n := copy(r.buf[end:], data)
+	copy(r.buf, data[n:])
+	r.length += len(data)
+	r.cond.Broadcast()
+}
+
+// grow enlarges the ring to hold at least size bytes, returning false if
+// that would exceed the maximum.
+func (r *captureRing) grow(size int) bool {
+	if size > r.max {
+		return false
+	}
+	newSize := 2 * len(r.buf)
+	for newSize < size {
+		newSize *= 2
+	}
+	if newSize > r.max {
+		newSize = r.max
+	}
+	buf := make([]byte, newSize)
+	r.copyOut(buf[:r.length])
+	r.buf = buf
+	r.start = 0
+	return true
+}
+
+// read fills dst from the ring, waiting for enough data to arrive.
+func (r *captureRing) read(dst []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.length < len(dst) && !r.overrun && r.err == nil && !r.stopped {
+		r.cond.Wait()
+	}
+	if r.overrun {
+		r.overrun = false
+		r.start = 0
+		r.length = 0
+		return ErrOverrun
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if r.length < len(dst) {
+		return ErrClosed
+	}
+	r.copyOut(dst)
+	r.start = (r.start + len(dst)) % len(r.buf)
+	r.length -= len(dst)
+	return nil
+}
+
+// copyOut copies len(dst) bytes from the head of the ring into dst,
+// wrapping around the end of the buffer.
+func (r *captureRing) copyOut(dst []byte) {
+	n := copy(dst, r.buf[r.start:])
+	copy(dst[n:], r.buf)
+}
+
+// stop stops the goroutine filling the ring and wakes any waiting reader.
+func (r *captureRing) stop() {
+	r.mu.Lock()
+	r.stopped = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	<-r.done
+}
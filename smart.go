@@ -0,0 +1,297 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"errors"
+	"math"
+	"unsafe"
+)
+
+/*
+#include <alsa/asoundlib.h>
+*/
+import "C"
+
+// AudioFormat describes the layout of a stream of audio samples.
+type AudioFormat struct {
+	Format   Format
+	Channels int
+	Rate     int
+}
+
+// SmartPlaybackDevice is a playback device which accepts audio in a source
+// format and converts it to whatever the hardware supports, adjusting the
+// sample format, channel count and rate as needed.
+type SmartPlaybackDevice struct {
+	*PlaybackDevice
+	Source    AudioFormat
+	decode    func(b []byte) float64
+	encode    func(b []byte, v float64)
+	resampler *linearResampler
+}
+
+// NewSmartPlaybackDevice opens a playback device in the supported format
+// closest to source and returns a device which converts from source on each
+// Write.
+func NewSmartPlaybackDevice(deviceName string, source AudioFormat, bufferParams BufferParams) (s *SmartPlaybackDevice, err error) {
+	if source.Channels <= 0 || source.Rate <= 0 {
+		return nil, errors.New("source format requires channels and rate")
+	}
+	granted, err := closestAudioFormat(deviceName, source)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPlaybackDevice(deviceName, granted.Channels, granted.Format, granted.Rate, bufferParams)
+	if err != nil {
+		return nil, err
+	}
+	s = &SmartPlaybackDevice{
+		PlaybackDevice: p,
+		Source:         source,
+		decode:         sampleDecoder(source.Format),
+		encode:         sampleEncoder(p.Format),
+	}
+	if p.Rate != source.Rate {
+		s.resampler = newLinearResampler(p.Channels, source.Rate, p.Rate)
+	}
+	return s, nil
+}
+
+// Write converts a buffer of samples in the source format to the device
+// format and writes all of it to the device. It returns the number of
+// source samples consumed, which on error is the number whose converted
+// audio was written before the error.
+func (s *SmartPlaybackDevice) Write(buffer interface{}) (samples int, err error) {
+	srcSampleSize := sampleSize(s.Source.Format)
+	in, err := bufferBytes(buffer, srcSampleSize)
+	if err != nil {
+		return 0, err
+	}
+	frames := len(in) / srcSampleSize / s.Source.Channels
+	if frames == 0 {
+		return 0, nil
+	}
+
+	decoded := make([]float64, frames*s.Source.Channels)
+	for i := range decoded {
+		decoded[i] = s.decode(in[i*srcSampleSize:])
+	}
+	mixed := mixChannels(decoded, s.Source.Channels, s.Channels)
+	if s.resampler != nil {
+		mixed = s.resampler.process(mixed)
+	}
+
+	s.lock()
+	defer s.unlock()
+	if s.h == nil {
+		return 0, ErrClosed
+	}
+	dstSampleSize := s.formatSampleSize()
+	out := s.scratchBuffer(len(mixed) * dstSampleSize)
+	for i, v := range mixed {
+		s.encode(out[i*dstSampleSize:], v)
+	}
+	frameBytes := s.Channels * dstSampleSize
+	outFrames := len(out) / frameBytes
+	total := 0
+	for total < outFrames {
+		written, err := s.writeFrames(unsafe.Pointer(&out[total*frameBytes]), outFrames-total)
+		total += written
+		if err != nil {
+			// Report the source frames which the written output covers
+			return total * frames / outFrames * s.Source.Channels, err
+		}
+	}
+	return frames * s.Source.Channels, nil
+}
+
+// closestAudioFormat probes a playback device for the supported audio
+// format closest to the requested one.
+func closestAudioFormat(deviceName string, requested AudioFormat) (granted AudioFormat, err error) {
+	err = probeHwParams(deviceName, true, func(h *C.snd_pcm_t, hwParams *C.snd_pcm_hw_params_t) error {
+		format, ok := nearestFormat(h, hwParams, requested.Format)
+		if !ok {
+			return errors.New("device supports no known format")
+		}
+		ret := C.snd_pcm_hw_params_set_format(h, hwParams, C.snd_pcm_format_t(format))
+		if ret < 0 {
+			return createError("could not set format params", ret)
+		}
+		var channels = C.uint(requested.Channels)
+		ret = C.snd_pcm_hw_params_set_channels_near(h, hwParams, &channels)
+		if ret < 0 {
+			return createError("could not set channels params", ret)
+		}
+		var rate = C.uint(requested.Rate)
+		ret = C.snd_pcm_hw_params_set_rate_near(h, hwParams, &rate, nil)
+		if ret < 0 {
+			return createError("could not set rate params", ret)
+		}
+		granted = AudioFormat{Format: format, Channels: int(channels), Rate: int(rate)}
+		return nil
+	})
+	return
+}
+
+// defaultFloatFormats is the order in which formats are tried for a
+// FloatPlaybackDevice when no preference is given, most precise first.
+var defaultFloatFormats = []Format{
+	FormatFloatLE, FormatS32LE, FormatS24LE, FormatS16LE, FormatS8, FormatU8,
+}
+
+// FloatPlaybackDevice is a playback device which accepts float samples and
+// converts them to the format negotiated with the hardware.
+type FloatPlaybackDevice struct {
+	*PlaybackDevice
+	encode func(b []byte, v float64)
+}
+
+// NewFloatPlaybackDevice opens a playback device in the first of the
+// preferred formats the hardware supports, trying a default list from most
+// to least precise if preferred is empty.
+func NewFloatPlaybackDevice(deviceName string, channels int, rate int, preferred []Format, bufferParams BufferParams) (f *FloatPlaybackDevice, err error) {
+	if len(preferred) == 0 {
+		preferred = defaultFloatFormats
+	}
+	format, err := preferredFormat(deviceName, preferred)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPlaybackDevice(deviceName, channels, format, rate, bufferParams)
+	if err != nil {
+		return nil, err
+	}
+	return &FloatPlaybackDevice{
+		PlaybackDevice: p,
+		encode:         sampleEncoder(p.Format),
+	}, nil
+}
+
+// WriteFloat32 converts a buffer of interleaved samples in the range
+// [-1, 1] to the device format and writes all of it to the device. On
+// error the number of samples written before it is returned.
+func (f *FloatPlaybackDevice) WriteFloat32(buffer []float32) (samples int, err error) {
+	frames := len(buffer) / f.Channels
+	if frames == 0 {
+		return 0, nil
+	}
+
+	f.lock()
+	defer f.unlock()
+	if f.h == nil {
+		return 0, ErrClosed
+	}
+	sampleSize := f.formatSampleSize()
+	out := f.scratchBuffer(frames * f.Channels * sampleSize)
+	for i := 0; i < frames*f.Channels; i++ {
+		f.encode(out[i*sampleSize:], float64(buffer[i]))
+	}
+	frameBytes := f.Channels * sampleSize
+	total := 0
+	for total < frames {
+		written, err := f.writeFrames(unsafe.Pointer(&out[total*frameBytes]), frames-total)
+		total += written
+		if err != nil {
+			return total * f.Channels, err
+		}
+	}
+	return frames * f.Channels, nil
+}
+
+// preferredFormat probes a playback device for the first of the given
+// formats it supports.
+func preferredFormat(deviceName string, preferred []Format) (format Format, err error) {
+	err = probeHwParams(deviceName, true, func(h *C.snd_pcm_t, hwParams *C.snd_pcm_hw_params_t) error {
+		for _, format = range preferred {
+			if C.snd_pcm_hw_params_test_format(h, hwParams, C.snd_pcm_format_t(format)) == 0 {
+				return nil
+			}
+		}
+		return errors.New("device supports none of the preferred formats")
+	})
+	return
+}
+
+// mixChannels converts interleaved samples between channel counts. Channels
+// are duplicated when upmixing and averaged when downmixing, so that output
+// channel i is made from the input channels congruent to i.
+func mixChannels(in []float64, from, to int) []float64 {
+	if from == to {
+		return in
+	}
+	frames := len(in) / from
+	out := make([]float64, frames*to)
+	for f := 0; f < frames; f++ {
+		src := in[f*from : (f+1)*from]
+		dst := out[f*to : (f+1)*to]
+		if to > from {
+			for i := range dst {
+				dst[i] = src[i%from]
+			}
+			continue
+		}
+		counts := make([]int, to)
+		for i, v := range src {
+			dst[i%to] += v
+			counts[i%to]++
+		}
+		for i := range dst {
+			dst[i] /= float64(counts[i])
+		}
+	}
+	return out
+}
+
+// linearResampler converts interleaved samples between rates by linear
+// interpolation, carrying its position across calls so that consecutive
+// blocks join up.
+type linearResampler struct {
+	channels int
+	step     float64
+	// pos is the position of the next output frame relative to the first
+	// frame of the next input block, -1 being the last frame of the
+	// previous block
+	pos  float64
+	prev []float64
+}
+
+func newLinearResampler(channels, fromRate, toRate int) *linearResampler {
+	return &linearResampler{
+		channels: channels,
+		step:     float64(fromRate) / float64(toRate),
+	}
+}
+
+func (r *linearResampler) process(in []float64) []float64 {
+	frames := len(in) / r.channels
+	if frames == 0 {
+		return nil
+	}
+	frame := func(i int) []float64 {
+		if i < 0 {
+			return r.prev
+		}
+		return in[i*r.channels : (i+1)*r.channels]
+	}
+	out := make([]float64, 0, int(float64(frames)/r.step+2)*r.channels)
+	for r.pos <= float64(frames-1) {
+		i := int(math.Floor(r.pos))
+		frac := r.pos - float64(i)
+		a := frame(i)
+		if i+1 > frames-1 {
+			out = append(out, a...)
+		} else {
+			b := frame(i + 1)
+			for c := 0; c < r.channels; c++ {
+				out = append(out, a[c]+(b[c]-a[c])*frac)
+			}
+		}
+		r.pos += r.step
+	}
+	r.pos -= float64(frames)
+	r.prev = append(r.prev[:0], frame(frames-1)...)
+	return out
+}
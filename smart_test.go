@@ -0,0 +1,82 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"testing"
+
+	"github.com/cocoonlife/testify/assert"
+)
+
+func TestMixChannels(t *testing.T) {
+	a := assert.New(t)
+
+	a.Equal(mixChannels([]float64{0.5, -0.5}, 1, 2),
+		[]float64{0.5, 0.5, -0.5, -0.5}, "mono upmixed to stereo")
+	a.Equal(mixChannels([]float64{1, 0, 0.5, 0.5}, 2, 1),
+		[]float64{0.5, 0.5}, "stereo downmixed to mono")
+}
+
+func TestLinearResampler(t *testing.T) {
+	a := assert.New(t)
+
+	r := newLinearResampler(1, 1, 2)
+
+	a.Equal(r.process([]float64{0, 1}), []float64{0, 0.5, 1}, "first block upsampled")
+	a.Equal(r.process([]float64{0}), []float64{0.5, 0}, "second block joins first")
+
+	r = newLinearResampler(1, 2, 1)
+
+	a.Equal(r.process([]float64{0, 1, 2, 3, 4}), []float64{0, 2, 4}, "downsampled")
+}
+
+func TestSmartPlayback(t *testing.T) {
+	a := assert.New(t)
+
+	s, err := NewSmartPlaybackDevice("null",
+		AudioFormat{Format: FormatS16LE, Channels: 2, Rate: 22050},
+		BufferParams{})
+
+	a.NoError(err, "created smart playback device")
+
+	_, err = s.Write(make([]int32, 100))
+
+	a.Error(err, "wrong type error")
+
+	samples, err := s.Write(make([]int16, 200))
+
+	a.NoError(err, "buffer written ok")
+	a.Equal(samples, 200, "all samples consumed")
+
+	s.Close()
+}
+
+func TestFloatPlayback(t *testing.T) {
+	a := assert.New(t)
+
+	f, err := NewFloatPlaybackDevice("null", 2, 44100, nil, BufferParams{})
+
+	a.NoError(err, "created float playback device")
+	a.Equal(f.Format, defaultFloatFormats[0], "most precise format chosen")
+
+	f.Close()
+
+	f, err = NewFloatPlaybackDevice("null", 2, 44100,
+		[]Format{FormatS16LE, FormatS32LE}, BufferParams{})
+
+	a.NoError(err, "created float playback device")
+	a.Equal(f.Format, Format(FormatS16LE), "first preference chosen")
+
+	samples, err := f.WriteFloat32(make([]float32, 200))
+
+	a.NoError(err, "buffer written ok")
+	a.Equal(samples, 200, "all samples written")
+
+	f.Close()
+
+	_, err = f.WriteFloat32(make([]float32, 200))
+
+	a.Equal(err, ErrClosed, "device is closed")
+}
@@ -0,0 +1,199 @@
+// Copyright 2015-2016 Cocoon Labs Ltd.
+//
+// See LICENSE file for terms and conditions.
+
+package alsa
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+/*
+#include <alsa/asoundlib.h>
+#include <stdlib.h>
+*/
+import "C"
+
+// PCMVolume reports the volume of a PCM stream.
+type PCMVolume struct {
+	Min int
+	Max int
+	// Values holds the raw volume of each channel.
+	Values []int
+	// DB holds the gain of each channel in dB, it is empty if the driver
+	// does not describe the volume range with TLV data.
+	DB []float64
+}
+
+// Names of the volume controls drivers attach to a PCM stream, as opposed
+// to the card wide mixer controls.
+var pcmVolumeNames = map[C.snd_pcm_stream_t][]string{
+	C.SND_PCM_STREAM_PLAYBACK: {"PCM Playback Volume", "Playback Volume"},
+	C.SND_PCM_STREAM_CAPTURE:  {"PCM Capture Volume", "Capture Volume"},
+}
+
+type pcmVolumeControl struct {
+	ctl  *C.snd_ctl_t
+	id   *C.snd_ctl_elem_id_t
+	info *C.snd_ctl_elem_info_t
+}
+
+// openPCMVolume finds the volume control attached to the device's PCM. It
+// returns ErrNoPCMVolume if there is none, in which case the volume can
+// only be controlled through the card mixer.
+func (d *device) openPCMVolume() (control *pcmVolumeControl, err error) {
+	if d.h == nil {
+		return nil, ErrClosed
+	}
+	var pcmInfo *C.snd_pcm_info_t
+	ret := C.snd_pcm_info_malloc(&pcmInfo)
+	if ret < 0 {
+		return nil, createError("could not alloc pcm info", ret)
+	}
+	defer C.snd_pcm_info_free(pcmInfo)
+	ret = C.snd_pcm_info(d.h, pcmInfo)
+	if ret < 0 {
+		return nil, createError("could not get pcm info", ret)
+	}
+	card := C.snd_pcm_info_get_card(pcmInfo)
+	if card < 0 {
+		return nil, ErrNoPCMVolume
+	}
+
+	v := new(pcmVolumeControl)
+	defer func() {
+		if err != nil {
+			v.close()
+		}
+	}()
+	ctlName := C.CString(fmt.Sprintf("hw:%d", card))
+	defer C.free(unsafe.Pointer(ctlName))
+	ret = C.snd_ctl_open(&v.ctl, ctlName, 0)
+	if ret < 0 {
+		return nil, createError(fmt.Sprintf("could not open card %d", card), ret)
+	}
+	ret = C.snd_ctl_elem_id_malloc(&v.id)
+	if ret < 0 {
+		return nil, createError("could not alloc control id", ret)
+	}
+	ret = C.snd_ctl_elem_info_malloc(&v.info)
+	if ret < 0 {
+		return nil, createError("could not alloc control info", ret)
+	}
+	C.snd_ctl_elem_id_set_interface(v.id, C.SND_CTL_ELEM_IFACE_PCM)
+	C.snd_ctl_elem_id_set_device(v.id, C.snd_pcm_info_get_device(pcmInfo))
+	C.snd_ctl_elem_id_set_subdevice(v.id, C.snd_pcm_info_get_subdevice(pcmInfo))
+	for _, name := range pcmVolumeNames[C.snd_pcm_stream(d.h)] {
+		nameCString := C.CString(name)
+		C.snd_ctl_elem_id_set_name(v.id, nameCString)
+		C.free(unsafe.Pointer(nameCString))
+		C.snd_ctl_elem_info_set_id(v.info, v.id)
+		if C.snd_ctl_elem_info(v.ctl, v.info) == 0 &&
+			C.snd_ctl_elem_info_get_type(v.info) == C.SND_CTL_ELEM_TYPE_INTEGER {
+			C.snd_ctl_elem_info_get_id(v.info, v.id)
+			return v, nil
+		}
+	}
+	return nil, ErrNoPCMVolume
+}
+
+func (v *pcmVolumeControl) close() {
+	if v.info != nil {
+		C.snd_ctl_elem_info_free(v.info)
+	}
+	if v.id != nil {
+		C.snd_ctl_elem_id_free(v.id)
+	}
+	if v.ctl != nil {
+		C.snd_ctl_close(v.ctl)
+	}
+}
+
+// GetPCMVolume returns the volume of the device for drivers which attach
+// a volume control to the PCM stream itself. It returns ErrNoPCMVolume if
+// the volume is only available through the card mixer.
+func (d *device) GetPCMVolume() (volume PCMVolume, err error) {
+	d.lock()
+	defer d.unlock()
+	v, err := d.openPCMVolume()
+	if err != nil {
+		return volume, err
+	}
+	defer v.close()
+
+	var value *C.snd_ctl_elem_value_t
+	ret := C.snd_ctl_elem_value_malloc(&value)
+	if ret < 0 {
+		return volume, createError("could not alloc control value", ret)
+	}
+	defer C.snd_ctl_elem_value_free(value)
+	C.snd_ctl_elem_value_set_id(value, v.id)
+	ret = C.snd_ctl_elem_read(v.ctl, value)
+	if ret < 0 {
+		return volume, createError("could not read volume", ret)
+	}
+
+	min := C.snd_ctl_elem_info_get_min(v.info)
+	max := C.snd_ctl_elem_info_get_max(v.info)
+	volume.Min = int(min)
+	volume.Max = int(max)
+	count := int(C.snd_ctl_elem_info_get_count(v.info))
+	for i := 0; i < count; i++ {
+		volume.Values = append(volume.Values, int(C.snd_ctl_elem_value_get_integer(value, C.uint(i))))
+	}
+
+	if C.snd_ctl_elem_info_is_tlv_readable(v.info) == 0 {
+		return volume, nil
+	}
+	var tlv [64]C.uint
+	if C.snd_ctl_elem_tlv_read(v.ctl, v.id, &tlv[0], C.uint(unsafe.Sizeof(tlv))) < 0 {
+		return volume, nil
+	}
+	for _, raw := range volume.Values {
+		var gain C.long
+		if C.snd_tlv_convert_to_dB(&tlv[0], min, max, C.long(raw), &gain) < 0 {
+			volume.DB = nil
+			break
+		}
+		// TLV gains are in hundredths of a dB
+		volume.DB = append(volume.DB, float64(gain)/100)
+	}
+	return volume, nil
+}
+
+// SetPCMVolume sets the raw volume of every channel of the device for
+// drivers which attach a volume control to the PCM stream itself. It
+// returns ErrNoPCMVolume if the volume is only available through the card
+// mixer.
+func (d *device) SetPCMVolume(level int) (err error) {
+	d.lock()
+	defer d.unlock()
+	v, err := d.openPCMVolume()
+	if err != nil {
+		return err
+	}
+	defer v.close()
+
+	min := int(C.snd_ctl_elem_info_get_min(v.info))
+	max := int(C.snd_ctl_elem_info_get_max(v.info))
+	if level < min || level > max {
+		return fmt.Errorf("volume %d outside range %d to %d", level, min, max)
+	}
+	var value *C.snd_ctl_elem_value_t
+	ret := C.snd_ctl_elem_value_malloc(&value)
+	if ret < 0 {
+		return createError("could not alloc control value", ret)
+	}
+	defer C.snd_ctl_elem_value_free(value)
+	C.snd_ctl_elem_value_set_id(value, v.id)
+	count := int(C.snd_ctl_elem_info_get_count(v.info))
+	for i := 0; i < count; i++ {
+		C.snd_ctl_elem_value_set_integer(value, C.uint(i), C.long(level))
+	}
+	ret = C.snd_ctl_elem_write(v.ctl, value)
+	if ret < 0 {
+		return createError("could not write volume", ret)
+	}
+	return nil
+}